@@ -0,0 +1,389 @@
+// Package articles publishes Markdown articles, with an index, tag
+// pages, Atom and RSS feeds and a sitemap
+package articles
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logger is used for everything the package logs
+var logger = slog.Default()
+
+// SetLogger sets the logger used by the articles package
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// How often Reload looks for changed files
+const reloadInterval = time.Second
+
+//go:embed templates
+var templateFiles embed.FS
+
+// Config sets up a Site
+type Config struct {
+	// Dir is the directory with the articles in, like "articles". Each
+	// article is a .md file, and its name (without .md) is its URL
+	Dir string
+	// Prefix is where the site is mounted, like /articles/
+	Prefix string
+	// Title is used for the index and the feeds
+	Title string
+	// Author is used for articles that don't give one
+	Author string
+	// Fallback serves anything under Prefix that isn't an article, like
+	// images. Without one, those requests get 404
+	Fallback http.Handler
+	// AssetPath gives the path to use for a file like /css/core.css, so
+	// that fingerprinted names can be used. Optional
+	AssetPath func(string) string
+	// Reload looks for changed articles at most once a second, while
+	// requests are coming in. Meant for debug mode
+	Reload bool
+	// Drafts shows articles with draft: true in their front matter
+	Drafts bool
+	// BaseURL is the canonical scheme and host, like https://example.com,
+	// for the absolute URLs in feeds and the sitemap. Without it, they're
+	// built from the request, so they change with the name the site is
+	// reached by
+	BaseURL string
+}
+
+// Article is one article, from the front matter and Markdown
+type Article struct {
+	Slug        string
+	Title       string
+	Description string
+	Author      string
+	Date        time.Time
+	Updated     time.Time
+	Tags        []string
+	Draft       bool
+	Body        template.HTML
+	// Outline is the headings in Body, nested by level
+	Outline []*Heading
+	// TOC is true if the article should have a table of contents
+	TOC bool
+}
+
+// Tag is a tag, and how many articles have it
+type Tag struct {
+	Name  string
+	Count int
+}
+
+// Site serves the articles
+type Site struct {
+	conf      Config
+	fsys      fs.FS
+	templates map[string]*template.Template
+
+	mu sync.RWMutex
+	// newest first
+	articles []*Article
+	bySlug   map[string]*Article
+	byTag    map[string][]*Article
+	tags     []Tag
+	// for Reload
+	sig     string
+	checked time.Time
+}
+
+// New reads the articles in conf.Dir from fsys
+func New(fsys fs.FS, conf Config) (*Site, error) {
+	if conf.Prefix == "" {
+		conf.Prefix = "/"
+	}
+	if !strings.HasPrefix(conf.Prefix, "/") || !strings.HasSuffix(conf.Prefix, "/") {
+		return nil, fmt.Errorf("Prefix %q must start and end with /", conf.Prefix)
+	}
+	if conf.Title == "" {
+		conf.Title = "Articles"
+	}
+	if conf.AssetPath == nil {
+		conf.AssetPath = func(p string) string { return p }
+	}
+	if conf.BaseURL != "" {
+		u, err := url.Parse(conf.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("BaseURL %q must be a scheme and host, like https://example.com", conf.BaseURL)
+		}
+		conf.BaseURL = u.Scheme + "://" + u.Host
+	}
+
+	s := &Site{conf: conf, fsys: fsys}
+	if err := s.parseTemplates(); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Site) parseTemplates() error {
+	funcs := template.FuncMap{
+		"asset":      s.conf.AssetPath,
+		"articleURL": s.articleURL,
+		"tagURL":     s.tagURL,
+		"prefix":     func() string { return s.conf.Prefix },
+		"date":       func(t time.Time) string { return t.Format("2 January 2006") },
+		"isoDate":    func(t time.Time) string { return t.Format(dateFormat) },
+	}
+	layout, err := template.New("layout.html").Funcs(funcs).ParseFS(templateFiles, "templates/layout.html")
+	if err != nil {
+		return err
+	}
+
+	s.templates = make(map[string]*template.Template)
+	for _, name := range []string{"article.html", "list.html", "tags.html"} {
+		t, err := template.Must(layout.Clone()).ParseFS(templateFiles, "templates/"+name)
+		if err != nil {
+			return err
+		}
+		s.templates[name] = t
+	}
+	return nil
+}
+
+func (s *Site) articleURL(slug string) string {
+	return s.conf.Prefix + slug
+}
+
+func (s *Site) tagURL(tag string) string {
+	return s.conf.Prefix + "tags/" + tag
+}
+
+// signature changes when any article is added, removed or changed
+func (s *Site) signature() (string, error) {
+	matches, err := fs.Glob(s.fsys, path.Join(s.conf.Dir, "*.md"))
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, name := range matches {
+		info, err := fs.Stat(s.fsys, name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// load reads all the articles
+func (s *Site) load() error {
+	sig, err := s.signature()
+	if err != nil {
+		return err
+	}
+
+	var articles []*Article
+	bySlug := make(map[string]*Article)
+	matches, err := fs.Glob(s.fsys, path.Join(s.conf.Dir, "*.md"))
+	if err != nil {
+		return err
+	}
+	for _, name := range matches {
+		slug := strings.TrimSuffix(path.Base(name), ".md")
+		if strings.HasPrefix(slug, ".") || strings.HasPrefix(slug, "_") {
+			continue
+		}
+		src, err := fs.ReadFile(s.fsys, name)
+		if err != nil {
+			return err
+		}
+		a, err := parseArticle(slug, src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if a.Draft && !s.conf.Drafts {
+			continue
+		}
+		if a.Author == "" {
+			a.Author = s.conf.Author
+		}
+		articles = append(articles, a)
+		bySlug[slug] = a
+	}
+
+	sort.SliceStable(articles, func(i, j int) bool {
+		if !articles[i].Date.Equal(articles[j].Date) {
+			return articles[i].Date.After(articles[j].Date)
+		}
+		return articles[i].Slug < articles[j].Slug
+	})
+
+	byTag := make(map[string][]*Article)
+	for _, a := range articles {
+		for _, t := range a.Tags {
+			byTag[t] = append(byTag[t], a)
+		}
+	}
+	tags := make([]Tag, 0, len(byTag))
+	for t, list := range byTag {
+		tags = append(tags, Tag{Name: t, Count: len(list)})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+
+	s.mu.Lock()
+	s.articles, s.bySlug, s.byTag, s.tags = articles, bySlug, byTag, tags
+	s.sig, s.checked = sig, time.Now()
+	s.mu.Unlock()
+
+	logger.Info("Loaded articles", "count", len(articles), "tags", len(tags))
+	return nil
+}
+
+// reload loads the articles again if they've changed. Mistakes are
+// logged, and the old articles are kept
+func (s *Site) reload() {
+	s.mu.Lock()
+	if time.Since(s.checked) < reloadInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.checked = time.Now()
+	old := s.sig
+	s.mu.Unlock()
+
+	sig, err := s.signature()
+	if err != nil {
+		logger.Warn("Can't check articles for changes", "err", err)
+		return
+	}
+	if sig == old {
+		return
+	}
+	if err := s.load(); err != nil {
+		logger.Warn("Can't reload articles", "err", err)
+	}
+}
+
+// Articles gives the articles, newest first
+func (s *Site) Articles() []*Article {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*Article(nil), s.articles...)
+}
+
+// pageData is passed to the templates
+type pageData struct {
+	Title       string
+	Description string
+	SiteTitle   string
+	Article     *Article
+	Articles    []*Article
+	Tag         string
+	Tags        []Tag
+}
+
+func (s *Site) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.conf.Reload {
+		s.reload()
+	}
+
+	if !strings.HasPrefix(r.URL.Path, s.conf.Prefix) {
+		s.notFound(w, r)
+		return
+	}
+	rel := strings.TrimPrefix(r.URL.Path, s.conf.Prefix)
+
+	s.mu.RLock()
+	articles, bySlug, byTag, tags := s.articles, s.bySlug, s.byTag, s.tags
+	s.mu.RUnlock()
+
+	data := pageData{SiteTitle: s.conf.Title}
+	switch {
+	case rel == "":
+		data.Title = s.conf.Title
+		data.Articles = articles
+		s.render(w, r, "list.html", data)
+	case rel == "atom.xml":
+		s.serveAtom(w, r, articles)
+	case rel == "rss.xml":
+		s.serveRSS(w, r, articles)
+	case rel == "outline.json":
+		s.serveOutline(w, r, nil, articles)
+	case rel == "tags/":
+		data.Title = "Tags"
+		data.Tags = tags
+		s.render(w, r, "tags.html", data)
+	case strings.HasPrefix(rel, "tags/"):
+		tag := strings.TrimPrefix(rel, "tags/")
+		list, ok := byTag[tag]
+		if !ok {
+			s.notFound(w, r)
+			return
+		}
+		data.Title = "Tagged " + tag
+		data.Tag = tag
+		data.Articles = list
+		s.render(w, r, "list.html", data)
+	case bySlug[rel] != nil:
+		a := bySlug[rel]
+		data.Title = a.Title
+		data.Description = a.Description
+		data.Article = a
+		s.render(w, r, "article.html", data)
+	case strings.HasSuffix(rel, ".json") && bySlug[strings.TrimSuffix(rel, ".json")] != nil:
+		s.serveOutline(w, r, bySlug[strings.TrimSuffix(rel, ".json")], nil)
+	case strings.HasSuffix(rel, ".html") && bySlug[strings.TrimSuffix(rel, ".html")] != nil:
+		// Articles used to be HTML files
+		http.Redirect(w, r, s.articleURL(strings.TrimSuffix(rel, ".html")), http.StatusMovedPermanently)
+	default:
+		s.notFound(w, r)
+	}
+}
+
+func (s *Site) notFound(w http.ResponseWriter, r *http.Request) {
+	if s.conf.Fallback != nil {
+		s.conf.Fallback.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// render renders a page into a buffer first, so that mistakes in the
+// templates give a clean 500
+func (s *Site) render(w http.ResponseWriter, r *http.Request, name string, data pageData) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var b bytes.Buffer
+	if err := s.templates[name].ExecuteTemplate(&b, "layout.html", data); err != nil {
+		logger.Error("Can't render page", "template", name, "path", r.URL.Path, "err", err)
+		http.Error(w, "Can't render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(b.Bytes())
+}
+
+// updated gives the newest date of any article, or the zero time if
+// there aren't any
+func updated(articles []*Article) time.Time {
+	var t time.Time
+	for _, a := range articles {
+		if a.Updated.After(t) {
+			t = a.Updated
+		}
+	}
+	return t
+}
@@ -0,0 +1,296 @@
+package articles
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+const testArticle = `---
+title: First post
+description: The first one
+date: 2020-01-02
+updated: 2020-02-03
+tags: [Home Network, go, go]
+---
+
+# Hello
+
+Some *Markdown*, and <span class="raw">HTML</span>.
+`
+
+func testFS() fstest.MapFS {
+	return fstest.MapFS{
+		"articles/first.md":  {Data: []byte(testArticle)},
+		"articles/second.md": {Data: []byte("---\ntitle: Second\nauthor: Someone\ndate: 2021-05-06\ntags: [go]\n---\nBody\n")},
+		"articles/draft.md":  {Data: []byte("---\ntitle: Draft\ndate: 2022-01-01\ndraft: true\n---\nNot yet\n")},
+		"articles/photo.png": {Data: []byte("png")},
+	}
+}
+
+func testSite(t *testing.T, fsys fstest.MapFS, conf Config) *Site {
+	t.Helper()
+	conf.Dir = "articles"
+	conf.Prefix = "/articles/"
+	s, err := New(fsys, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func get(h http.Handler, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestParseArticle(t *testing.T) {
+	a, err := parseArticle("first", []byte(testArticle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Title != "First post" || a.Description != "The first one" {
+		t.Errorf("Wrong front matter: %+v", a)
+	}
+	if a.Date != time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC) || a.Updated != time.Date(2020, 2, 3, 0, 0, 0, 0, time.UTC) {
+		t.Errorf("Wrong dates: %v %v", a.Date, a.Updated)
+	}
+	if strings.Join(a.Tags, ",") != "home-network,go" {
+		t.Errorf("Wrong tags: %v", a.Tags)
+	}
+	for _, s := range []string{`<h1 id="hello">Hello</h1>`, "<em>Markdown</em>", `<span class="raw">HTML</span>`} {
+		if !strings.Contains(string(a.Body), s) {
+			t.Errorf("Expected %s in\n%s", s, a.Body)
+		}
+	}
+
+	bad := []string{
+		"no front matter",
+		"---\ntitle: x\ndate: 2020-01-01\n",
+		"---\ndate: 2020-01-01\n---\n",
+		"---\ntitle: x\ndate: January\n---\n",
+		"---\ntitle: [x\n---\n",
+	}
+	for _, src := range bad {
+		if _, err := parseArticle("x", []byte(src)); err == nil {
+			t.Errorf("%q: expected an error", src)
+		}
+	}
+}
+
+func TestAnchorHeadings(t *testing.T) {
+	body := `<h1><a id="intro">Introduction</a></h1>
+<h2>Some &amp; History</h2>
+<h3 class="x" id='kept'>Kept</h3>
+<h2><a name="PSU">Power <em>supply</em></a></h2>
+<h2>Some &amp; History</h2>
+<h2>Intro</h2>
+<p id="intro-2">Taken</p>
+<h1>!!!</h1>
+<h2>Bad</h3>`
+	out, headings := anchorHeadings([]byte(body))
+	for _, s := range []string{
+		`<h1 id="intro">Introduction</h1>`,
+		`<h2 id="some-history">Some &amp; History</h2>`,
+		`<h3 class="x" id='kept'>Kept</h3>`,
+		`<h2 id="PSU">Power <em>supply</em></h2>`,
+		`<h2 id="some-history-2">`,
+		`<h2 id="intro-3">Intro</h2>`,
+		`<h1 id="section">!!!</h1>`,
+		`<h2>Bad</h3>`,
+	} {
+		if !strings.Contains(string(out), s) {
+			t.Errorf("Expected %s in\n%s", s, out)
+		}
+	}
+
+	var got []string
+	var walk func(prefix string, hs []*Heading)
+	walk = func(prefix string, hs []*Heading) {
+		for _, h := range hs {
+			got = append(got, prefix+h.ID+" "+h.Title)
+			walk(prefix+"  ", h.Children)
+		}
+	}
+	walk("", outline(headings))
+	expected := []string{
+		"intro Introduction",
+		"  some-history Some & History",
+		"    kept Kept",
+		"  PSU Power supply",
+		"  some-history-2 Some & History",
+		"  intro-3 Intro",
+		"section !!!",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Wrong outline:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestSite(t *testing.T) {
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fallback"))
+	})
+	s := testSite(t, testFS(), Config{
+		Fallback:  fallback,
+		AssetPath: func(p string) string { return strings.Replace(p, ".css", ".abc.css", 1) },
+	})
+
+	tests := []struct {
+		path     string
+		status   int
+		contains string
+	}{
+		{"/articles/", 200, `<a href="/articles/second">Second</a>`},
+		{"/articles/first", 200, `<h1 id="hello">Hello</h1>`},
+		{"/articles/first", 200, `<a href="/articles/tags/home-network">home-network</a>`},
+		{"/articles/first", 200, `href="/css/core.abc.css"`},
+		{"/articles/tags/", 200, `<a href="/articles/tags/go">go</a> (2)`},
+		{"/articles/tags/home-network", 200, `First post`},
+		{"/articles/tags/nope", 200, "fallback"},
+		{"/articles/draft", 200, "fallback"},
+		{"/articles/photo.png", 200, "fallback"},
+		{"/articles/first.html", 301, ""},
+		{"/articles/first.json", 200, `"headings":[{"level":1,"id":"hello","title":"Hello"}]`},
+		{"/articles/outline.json", 200, `{"slug":"second","title":"Second","url":"/articles/second","date":"2021-05-06","headings":[]}`},
+		{"/articles/draft.json", 200, "fallback"},
+	}
+	for _, tc := range tests {
+		w := get(s, tc.path)
+		if w.Code != tc.status || !strings.Contains(w.Body.String(), tc.contains) {
+			t.Errorf("%s: expected %d with %q, got %d\n%s", tc.path, tc.status, tc.contains, w.Code, w.Body.String())
+		}
+	}
+
+	if loc := get(s, "/articles/first.html").Header().Get("Location"); loc != "/articles/first" {
+		t.Errorf("Expected a redirect to /articles/first, got %q", loc)
+	}
+	if strings.Contains(get(s, "/articles/first").Body.String(), `class="toc"`) {
+		t.Error("Articles with one heading shouldn't have a table of contents")
+	}
+	if strings.Contains(get(s, "/articles/").Body.String(), "Draft") {
+		t.Error("Drafts shouldn't be listed")
+	}
+
+	withDrafts := testSite(t, testFS(), Config{Drafts: true})
+	if w := get(withDrafts, "/articles/draft"); w.Code != 200 {
+		t.Errorf("Expected the draft with Drafts set, got %d", w.Code)
+	}
+}
+
+func TestFeeds(t *testing.T) {
+	s := testSite(t, testFS(), Config{Title: "Test", Author: "Default"})
+
+	w := get(s, "/articles/atom.xml")
+	var atom atomFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &atom); err != nil {
+		t.Fatal(err)
+	}
+	if atom.Title != "Test" || atom.Updated != "2021-05-06T00:00:00Z" || len(atom.Entries) != 2 {
+		t.Fatalf("Wrong feed: %+v", atom)
+	}
+	if e := atom.Entries[0]; e.ID != "http://example.com/articles/second" || e.Author.Name != "Someone" {
+		t.Errorf("Wrong first entry: %+v", e)
+	}
+	if e := atom.Entries[1]; e.Author.Name != "Default" || !strings.Contains(e.Content.Body, "<em>Markdown</em>") {
+		t.Errorf("Wrong second entry: %+v", e)
+	}
+
+	w = get(s, "/articles/rss.xml")
+	var rss rssFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &rss); err != nil {
+		t.Fatal(err)
+	}
+	if len(rss.Channel.Items) != 2 || rss.Channel.Items[1].Description != "The first one" {
+		t.Errorf("Wrong RSS: %+v", rss)
+	}
+
+	w = get(s.Sitemap(), "/sitemap.xml")
+	var sm sitemap
+	if err := xml.Unmarshal(w.Body.Bytes(), &sm); err != nil {
+		t.Fatal(err)
+	}
+	var locs []string
+	for _, u := range sm.URLs {
+		locs = append(locs, u.Loc+" "+u.LastMod)
+	}
+	expected := []string{
+		"http://example.com/articles/ 2021-05-06",
+		"http://example.com/articles/second 2021-05-06",
+		"http://example.com/articles/first 2020-02-03",
+		"http://example.com/articles/tags/go 2021-05-06",
+		"http://example.com/articles/tags/home-network 2020-02-03",
+	}
+	if strings.Join(locs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Wrong sitemap:\n%s", strings.Join(locs, "\n"))
+	}
+}
+
+func TestFeedsBaseURL(t *testing.T) {
+	s := testSite(t, testFS(), Config{BaseURL: "https://canonical.example.com/"})
+
+	// The request's scheme and host don't matter once there's a BaseURL
+	r := httptest.NewRequest("GET", "http://other.example.com/articles/atom.xml", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	var atom atomFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &atom); err != nil {
+		t.Fatal(err)
+	}
+	if atom.ID != "https://canonical.example.com/articles/" || atom.Entries[0].ID != "https://canonical.example.com/articles/second" {
+		t.Errorf("Wrong IDs: %s %s", atom.ID, atom.Entries[0].ID)
+	}
+
+	for _, base := range []string{"canonical.example.com", "ftp://example.com", "https://example.com/blog", "https://"} {
+		if _, err := New(testFS(), Config{Dir: "articles", BaseURL: base}); err == nil {
+			t.Errorf("%s: expected an error", base)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	fsys := testFS()
+	s := testSite(t, fsys, Config{Reload: true})
+
+	fsys["articles/third.md"] = &fstest.MapFile{
+		Data:    []byte("---\ntitle: Third\ndate: 2023-01-01\n---\nNew\n"),
+		ModTime: time.Now(),
+	}
+	// Broken articles are ignored until they're fixed
+	fsys["articles/broken.md"] = &fstest.MapFile{Data: []byte("oops")}
+
+	s.checked = time.Time{}
+	if w := get(s, "/articles/third"); w.Code != 404 {
+		t.Errorf("Expected the old articles while one is broken, got %d", w.Code)
+	}
+
+	delete(fsys, "articles/broken.md")
+	s.checked = time.Time{}
+	if w := get(s, "/articles/third"); w.Code != 200 {
+		t.Errorf("Expected the new article, got %d", w.Code)
+	}
+}
+
+// The articles in wwwroot should all be valid, and raw HTML in them
+// shouldn't turn into code blocks by accident
+func TestWwwroot(t *testing.T) {
+	s, err := New(os.DirFS("../wwwroot"), Config{Dir: "articles", Prefix: "/articles/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range s.Articles() {
+		if strings.Contains(string(a.Body), "<pre><code>&lt;") {
+			t.Errorf("%s: HTML turned into a code block", a.Slug)
+		}
+		if strings.Contains(string(a.Body), "<a id=") || strings.Contains(string(a.Body), "<a name=") {
+			t.Errorf("%s: old style heading anchors left in", a.Slug)
+		}
+	}
+}
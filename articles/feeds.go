@@ -0,0 +1,217 @@
+package articles
+
+import (
+	"encoding/xml"
+	"net/http"
+	"time"
+
+	"github.com/moosemorals/mm/server"
+)
+
+// How many articles go in the feeds
+const feedLength = 20
+
+// baseURL gives the scheme and host for the absolute URLs that feeds and
+// sitemaps need: the configured BaseURL, or else the ones r was sent to
+func (s *Site) baseURL(r *http.Request) string {
+	if s.conf.BaseURL != "" {
+		return s.conf.BaseURL
+	}
+	return server.Scheme(r) + "://" + r.Host
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Link      atomLink    `xml:"link"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Author    *atomPerson `xml:"author,omitempty"`
+	Category  []atomCategory
+	Summary   *atomText `xml:"summary,omitempty"`
+	Content   atomText  `xml:"content"`
+}
+
+type atomCategory struct {
+	XMLName xml.Name `xml:"category"`
+	Term    string   `xml:"term,attr"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  *atomPerson `xml:"author,omitempty"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func (s *Site) serveAtom(w http.ResponseWriter, r *http.Request, articles []*Article) {
+	base := s.baseURL(r)
+	feed := atomFeed{
+		Title: s.conf.Title,
+		ID:    base + s.conf.Prefix,
+		Links: []atomLink{
+			{Href: base + s.conf.Prefix},
+			{Href: base + s.conf.Prefix + "atom.xml", Rel: "self", Type: "application/atom+xml"},
+		},
+		Updated: updated(articles).Format(time.RFC3339),
+	}
+	if s.conf.Author != "" {
+		feed.Author = &atomPerson{Name: s.conf.Author}
+	}
+
+	if len(articles) > feedLength {
+		articles = articles[:feedLength]
+	}
+	for _, a := range articles {
+		url := base + s.articleURL(a.Slug)
+		e := atomEntry{
+			Title:     a.Title,
+			ID:        url,
+			Link:      atomLink{Href: url},
+			Published: a.Date.Format(time.RFC3339),
+			Updated:   a.Updated.Format(time.RFC3339),
+			Content:   atomText{Type: "html", Body: string(a.Body)},
+		}
+		if a.Author != "" {
+			e.Author = &atomPerson{Name: a.Author}
+		}
+		if a.Description != "" {
+			e.Summary = &atomText{Body: a.Description}
+		}
+		for _, t := range a.Tags {
+			e.Category = append(e.Category, atomCategory{Term: t})
+		}
+		feed.Entries = append(feed.Entries, e)
+	}
+
+	writeXML(w, "application/atom+xml; charset=utf-8", feed)
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        string   `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Description string   `xml:"description"`
+	Category    []string `xml:"category"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+func (s *Site) serveRSS(w http.ResponseWriter, r *http.Request, articles []*Article) {
+	base := s.baseURL(r)
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         s.conf.Title,
+			Link:          base + s.conf.Prefix,
+			Description:   s.conf.Title,
+			LastBuildDate: updated(articles).Format(time.RFC1123Z),
+		},
+	}
+
+	if len(articles) > feedLength {
+		articles = articles[:feedLength]
+	}
+	for _, a := range articles {
+		url := base + s.articleURL(a.Slug)
+		desc := a.Description
+		if desc == "" {
+			desc = string(a.Body)
+		}
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       a.Title,
+			Link:        url,
+			GUID:        url,
+			PubDate:     a.Date.Format(time.RFC1123Z),
+			Description: desc,
+			Category:    a.Tags,
+		})
+	}
+
+	writeXML(w, "application/rss+xml; charset=utf-8", feed)
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemap struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// Sitemap serves sitemap.xml, listing the index, the articles and the
+// tag pages. It should be mounted at /sitemap.xml
+func (s *Site) Sitemap() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.conf.Reload {
+			s.reload()
+		}
+		s.mu.RLock()
+		articles, byTag, tags := s.articles, s.byTag, s.tags
+		s.mu.RUnlock()
+
+		base := s.baseURL(r)
+		sm := sitemap{URLs: []sitemapURL{{Loc: base + s.conf.Prefix, LastMod: lastMod(updated(articles))}}}
+		for _, a := range articles {
+			sm.URLs = append(sm.URLs, sitemapURL{Loc: base + s.articleURL(a.Slug), LastMod: lastMod(a.Updated)})
+		}
+		for _, t := range tags {
+			sm.URLs = append(sm.URLs, sitemapURL{Loc: base + s.tagURL(t.Name), LastMod: lastMod(updated(byTag[t.Name]))})
+		}
+
+		writeXML(w, "application/xml; charset=utf-8", sm)
+	})
+}
+
+func lastMod(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(dateFormat)
+}
+
+func writeXML(w http.ResponseWriter, contentType string, v interface{}) {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		logger.Error("Can't write XML", "err", err)
+		http.Error(w, "Can't write XML", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
@@ -0,0 +1,9 @@
+module github.com/moosemorals/mm/articles
+
+require (
+	github.com/moosemorals/mm/server v0.0.0
+	github.com/yuin/goldmark v1.7.8
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+replace github.com/moosemorals/mm/server => ../server
@@ -0,0 +1,114 @@
+package articles
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+	"gopkg.in/yaml.v3"
+)
+
+// Dates in front matter look like this
+const dateFormat = "2006-01-02"
+
+// Articles are written by the site's authors, so raw HTML is allowed
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+// frontMatter is the YAML between --- lines at the top of an article
+type frontMatter struct {
+	Title       string   `yaml:"title"`
+	Description string   `yaml:"description"`
+	Author      string   `yaml:"author"`
+	Date        string   `yaml:"date"`
+	Updated     string   `yaml:"updated"`
+	Tags        []string `yaml:"tags"`
+	Draft       bool     `yaml:"draft"`
+	// TOC can be set to false to leave out the table of contents
+	TOC *bool `yaml:"toc"`
+}
+
+// splitFrontMatter splits an article into its front matter and body
+func splitFrontMatter(src []byte) ([]byte, []byte, error) {
+	src = bytes.ReplaceAll(src, []byte("\r\n"), []byte("\n"))
+	if !bytes.HasPrefix(src, []byte("---\n")) {
+		return nil, nil, errors.New("Missing front matter, expected --- on the first line")
+	}
+	rest := src[4:]
+	end := bytes.Index(rest, []byte("\n---\n"))
+	if end < 0 {
+		if bytes.HasSuffix(rest, []byte("\n---")) {
+			return rest[:len(rest)-4], nil, nil
+		}
+		return nil, nil, errors.New("Front matter isn't closed with ---")
+	}
+	return rest[:end], rest[end+5:], nil
+}
+
+// parseArticle reads an article from Markdown with front matter
+func parseArticle(slug string, src []byte) (*Article, error) {
+	head, body, err := splitFrontMatter(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var fm frontMatter
+	if err := yaml.Unmarshal(head, &fm); err != nil {
+		return nil, err
+	}
+	if fm.Title == "" {
+		return nil, errors.New("Missing title")
+	}
+
+	a := &Article{
+		Slug:        slug,
+		Title:       fm.Title,
+		Description: fm.Description,
+		Author:      fm.Author,
+		Draft:       fm.Draft,
+	}
+	if a.Date, err = time.Parse(dateFormat, fm.Date); err != nil {
+		return nil, fmt.Errorf("Bad date %q, expected YYYY-MM-DD", fm.Date)
+	}
+	a.Updated = a.Date
+	if fm.Updated != "" {
+		if a.Updated, err = time.Parse(dateFormat, fm.Updated); err != nil {
+			return nil, fmt.Errorf("Bad updated date %q, expected YYYY-MM-DD", fm.Updated)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, t := range fm.Tags {
+		t = tagSlug(t)
+		if t != "" && !seen[t] {
+			a.Tags = append(a.Tags, t)
+			seen[t] = true
+		}
+	}
+
+	var out bytes.Buffer
+	if err := markdown.Convert(body, &out); err != nil {
+		return nil, err
+	}
+	body, headings := anchorHeadings(out.Bytes())
+	a.Body = template.HTML(body)
+	a.Outline = outline(headings)
+	a.TOC = len(headings) >= minTOC && (fm.TOC == nil || *fm.TOC)
+	return a, nil
+}
+
+var notSlug = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// tagSlug makes a tag safe for URLs, like "Home Network" to home-network
+func tagSlug(tag string) string {
+	return notSlug.ReplaceAllString(strings.Join(strings.Fields(strings.ToLower(tag)), "-"), "")
+}
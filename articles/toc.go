@@ -0,0 +1,154 @@
+package articles
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Articles with fewer headings than this don't get a table of contents
+const minTOC = 2
+
+// Heading is a heading in an article, with the headings under it
+type Heading struct {
+	Level    int        `json:"level"`
+	ID       string     `json:"id"`
+	Title    string     `json:"title"`
+	Children []*Heading `json:"children,omitempty"`
+}
+
+var (
+	// Go regexps can't match the closing tag to the opening one, so
+	// that's checked by hand
+	headingTag = regexp.MustCompile(`(?is)<h([1-6])(\s[^>]*)?>(.*?)</h([1-6])\s*>`)
+	idAttr     = regexp.MustCompile(`(?is)\s(?:id|name)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	// Headings used to be marked with <a id="..."> or <a name="...">
+	namedAnchor = regexp.MustCompile(`(?is)^\s*<a\s+(?:id|name)\s*=\s*"([^"]*)"\s*>(.*)</a>\s*$`)
+	anyTag      = regexp.MustCompile(`(?s)<[^>]*>`)
+	notID       = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// anchorHeadings gives every heading in body an id, and returns the
+// headings in the order they appear. Headings that already have an id,
+// or an old style anchor, keep it so that links to them still work.
+// Others get one from their text, like "Some History" to some-history
+func anchorHeadings(body []byte) ([]byte, []*Heading) {
+	used := make(map[string]bool)
+	for _, m := range idAttr.FindAllSubmatch(body, -1) {
+		used[string(m[1])+string(m[2])] = true
+	}
+
+	var headings []*Heading
+	out := headingTag.ReplaceAllFunc(body, func(m []byte) []byte {
+		parts := headingTag.FindSubmatch(m)
+		if string(parts[1]) != string(parts[4]) {
+			return m
+		}
+		level, _ := strconv.Atoi(string(parts[1]))
+		attrs, inner := string(parts[2]), string(parts[3])
+
+		id := ""
+		if a := idAttr.FindStringSubmatch(attrs); a != nil {
+			id = html.UnescapeString(a[1] + a[2])
+		} else if a := namedAnchor.FindStringSubmatch(inner); a != nil {
+			id = html.UnescapeString(a[1])
+			inner = a[2]
+			attrs += ` id="` + html.EscapeString(id) + `"`
+		}
+
+		title := strings.Join(strings.Fields(html.UnescapeString(anyTag.ReplaceAllString(inner, ""))), " ")
+		if id == "" {
+			id = uniqueID(headingID(title), used)
+			attrs += ` id="` + id + `"`
+		}
+
+		headings = append(headings, &Heading{Level: level, ID: id, Title: title})
+		n := string(parts[1])
+		return []byte("<h" + n + attrs + ">" + inner + "</h" + n + ">")
+	})
+	return out, headings
+}
+
+// headingID makes an id from a heading's text
+func headingID(title string) string {
+	id := strings.Trim(notID.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if id == "" {
+		return "section"
+	}
+	return id
+}
+
+// uniqueID adds -2, -3 and so on to id until it isn't used, and marks it
+// as used
+func uniqueID(id string, used map[string]bool) string {
+	unique := id
+	for i := 2; used[unique]; i++ {
+		unique = id + "-" + strconv.Itoa(i)
+	}
+	used[unique] = true
+	return unique
+}
+
+// outline nests headings under the nearest heading before them with a
+// lower level
+func outline(headings []*Heading) []*Heading {
+	var top, stack []*Heading
+	for _, h := range headings {
+		for len(stack) > 0 && stack[len(stack)-1].Level >= h.Level {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			top = append(top, h)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, h)
+		}
+		stack = append(stack, h)
+	}
+	return top
+}
+
+// articleOutline is an article's entry in the JSON outline
+type articleOutline struct {
+	Slug     string     `json:"slug"`
+	Title    string     `json:"title"`
+	URL      string     `json:"url"`
+	Date     string     `json:"date"`
+	Headings []*Heading `json:"headings"`
+}
+
+func (s *Site) outlineOf(a *Article) articleOutline {
+	headings := a.Outline
+	if headings == nil {
+		headings = []*Heading{}
+	}
+	return articleOutline{
+		Slug:     a.Slug,
+		Title:    a.Title,
+		URL:      s.articleURL(a.Slug),
+		Date:     a.Date.Format(dateFormat),
+		Headings: headings,
+	}
+}
+
+// serveOutline serves the outline of one article, or of all of them
+// (newest first) if a is nil
+func (s *Site) serveOutline(w http.ResponseWriter, r *http.Request, a *Article, articles []*Article) {
+	var v interface{}
+	if a != nil {
+		v = s.outlineOf(a)
+	} else {
+		list := make([]articleOutline, 0, len(articles))
+		for _, a := range articles {
+			list = append(list, s.outlineOf(a))
+		}
+		v = list
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(v)
+}
@@ -2,22 +2,52 @@ package eveapi
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
-	"log"
+	"io/fs"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
-const cacheBase = "cache/"
+const (
+	// Each cached response has its cacheMeta next to it, with this added
+	// to the name
+	metaSuffix = ".meta"
+	// Files being written start with this
+	tempPrefix = ".tmp-"
+)
 
 type cacheEntry struct {
 	responseTime time.Time
 	maxAge       time.Duration
+	// etag is used to ask ESI whether a stale entry has changed
+	etag string
+	// header replaces headers in the saved response after a 304, so
+	// Date and Expires match the new expiry
+	header http.Header
+}
+
+// cacheMeta is saved next to each cached response, so the cache can be
+// loaded again after a restart
+type cacheMeta struct {
+	Target       string
+	Owner        string `json:",omitempty"`
+	ResponseTime time.Time
+	MaxAge       time.Duration
+	ETag         string      `json:",omitempty"`
+	Header       http.Header `json:",omitempty"`
 }
 
+// Headers from a 304 that replace the ones in the saved response
+var revalidatedHeaders = []string{"Date", "Expires", "Last-Modified", "Cache-Control", "ETag"}
+
 func (e *cacheEntry) fresh() bool {
 	return time.Since(e.responseTime) < e.maxAge
 }
@@ -26,13 +56,58 @@ func (e *cacheEntry) tilStale() time.Duration {
 	return time.Duration(e.maxAge - time.Since(e.responseTime))
 }
 
+// call is an upstream fetch that other requests for the same target
+// wait on, rather than making their own
+type call struct {
+	done chan struct{}
+	// the whole response, as written by http.Response.Write, or the
+	// refreshed entry if ESI said it hadn't changed
+	raw   []byte
+	entry *cacheEntry
+	err   error
+}
+
+func (c *apiCache) callResponse(key cacheKey, cl *call) (*http.Response, error) {
+	if cl.err != nil {
+		return nil, cl.err
+	}
+	if cl.entry != nil {
+		return c.constructResponse(key, cl.entry)
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(cl.raw)), nil)
+}
+
+// cacheKey says who a cached response belongs to. owner is empty for
+// responses that are the same for everyone, and the character ID for
+// anything that depends on the token it was fetched with
+type cacheKey struct {
+	owner  string
+	target string
+}
+
 type apiCache struct {
-	store map[string]*cacheEntry
+	dir string
+	// recently used responses, so hits don't have to read the disk
+	memory  *memoryCache
+	metrics *metrics
+
+	mu    sync.Mutex
+	store map[cacheKey]*cacheEntry
+	// fetches in progress
+	calls map[cacheKey]*call
+	// how many times each owner has been purged, so fetches that started
+	// before a purge don't put anything back
+	purges map[string]uint64
 }
 
-func newAPICache() *apiCache {
+func newAPICache(dir string, maxMemory int64, m *metrics) *apiCache {
 	return &apiCache{
-		store: make(map[string]*cacheEntry),
+		dir:     dir,
+		memory:  newMemoryCache(maxMemory),
+		store:   make(map[cacheKey]*cacheEntry),
+		calls:   make(map[cacheKey]*call),
+		purges:  make(map[string]uint64),
+		metrics: m,
 	}
 }
 
@@ -42,8 +117,88 @@ func stringHash(in string) string {
 	return base64.URLEncoding.EncodeToString(sha.Sum(nil))
 }
 
-func cachePath(target string) string {
-	return cacheBase + stringHash(target)
+// ownerDir is where responses for owner are kept: public for everyone,
+// or characters/<id>, so one character's responses can be purged
+func (c *apiCache) ownerDir(owner string) string {
+	if owner == "" {
+		return filepath.Join(c.dir, "public")
+	}
+	return filepath.Join(c.dir, "characters", owner)
+}
+
+func (c *apiCache) path(key cacheKey) string {
+	return filepath.Join(c.ownerDir(key.owner), stringHash(key.target))
+}
+
+// metaPath is where the cacheMeta for key is saved
+func (c *apiCache) metaPath(key cacheKey) string {
+	return c.path(key) + metaSuffix
+}
+
+func (c *apiCache) saveMeta(key cacheKey, e *cacheEntry) error {
+	raw, err := json.Marshal(cacheMeta{
+		Target:       key.target,
+		Owner:        key.owner,
+		ResponseTime: e.responseTime,
+		MaxAge:       e.maxAge,
+		ETag:         e.etag,
+		Header:       e.header,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFile(c.metaPath(key), raw)
+}
+
+// load reads the entries saved by an earlier run. Entries whose response
+// has gone missing are skipped, and left for the janitor
+func (c *apiCache) load() error {
+	loaded := 0
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == c.dir {
+				return err
+			}
+			// One bad file or directory shouldn't lose the rest
+			logger.Warn("Can't read cache entry", "path", path, "err", err)
+			return nil
+		}
+		if d.IsDir() || !strings.HasSuffix(path, metaSuffix) {
+			return nil
+		}
+
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			logger.Warn("Can't read cache entry", "path", path, "err", err)
+			return nil
+		}
+		var m cacheMeta
+		if err := json.Unmarshal(raw, &m); err != nil {
+			logger.Warn("Can't read cache entry", "path", path, "err", err)
+			return nil
+		}
+		key := cacheKey{owner: m.Owner, target: m.Target}
+		if c.metaPath(key) != path {
+			logger.Warn("Cache entry is in the wrong place", "path", path, "target", m.Target)
+			return nil
+		}
+		if _, err := os.Stat(c.path(key)); err != nil {
+			return nil
+		}
+
+		c.mu.Lock()
+		c.store[key] = &cacheEntry{
+			responseTime: m.ResponseTime,
+			maxAge:       m.MaxAge,
+			etag:         m.ETag,
+			header:       m.Header,
+		}
+		c.mu.Unlock()
+		loaded++
+		return nil
+	})
+	logger.Info("Loaded cache", "entries", loaded)
+	return err
 }
 
 func calcMaxAge(resp *http.Response) time.Duration {
@@ -60,60 +215,250 @@ func calcMaxAge(resp *http.Response) time.Duration {
 	return expires.Sub(date)
 }
 
-func (c *apiCache) put(target string, resp *http.Response) (*cacheEntry, error) {
+// put saves a response to the cache, if it's fresh. raw is the whole
+// response, as written by http.Response.Write. purges is how many times
+// the owner had been purged when the fetch started
+func (c *apiCache) put(key cacheKey, purges uint64, resp *http.Response, raw []byte) error {
 	e := &cacheEntry{
 		responseTime: time.Now(),
 		maxAge:       calcMaxAge(resp),
+		etag:         resp.Header.Get("ETag"),
 	}
 
 	if !e.fresh() {
-		return nil, errors.New("Already stale")
+		return errors.New("Already stale")
+	}
+
+	path := c.path(key)
+	logger.Debug("Saving to cache", "target", key.target, "owner", key.owner, "path", path)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := writeFile(path, raw); err != nil {
+		return err
+	}
+	if err := c.saveMeta(key, e); err != nil {
+		return err
 	}
 
-	path := cachePath(target)
-	log.Printf("Saving body of %s to %s", target, path)
-	out, err := os.Create(path)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.purges[key.owner] != purges {
+		c.removeFiles(key)
+		os.Remove(filepath.Dir(path))
+		return errors.New("Purged while fetching")
+	}
+	c.store[key] = e
+	c.memory.add(key, raw)
+	return nil
+}
+
+// removeFiles deletes the files for key
+func (c *apiCache) removeFiles(key cacheKey) {
+	for _, path := range []string{c.metaPath(key), c.path(key)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Warn("Can't remove cache file", "path", path, "err", err)
+		}
+	}
+}
+
+// writeFile writes data somewhere else first and then renames it, so
+// readers never see half of it
+func writeFile(path string, data []byte) error {
+	out, err := os.CreateTemp(filepath.Dir(path), tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	if _, err := out.Write(data); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), path)
+}
+
+// constructResponse gives the saved response for an entry, from memory
+// if it's there, or from disk
+func (c *apiCache) constructResponse(key cacheKey, entry *cacheEntry) (*http.Response, error) {
+	raw, ok := c.memory.get(key)
+	if ok {
+		c.metrics.memoryHit()
+	} else {
+		path := c.path(key)
+		logger.Debug("Reading from cache", "target", key.target, "owner", key.owner, "path", path)
+		var err error
+		if raw, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+		c.memory.add(key, raw)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
 	if err != nil {
 		return nil, err
 	}
+	for name, values := range entry.header {
+		resp.Header[name] = values
+	}
+	return resp, nil
+}
 
-	defer resp.Body.Close()
+// refresh updates a stale entry after ESI says it hasn't changed. The
+// saved response is kept, and entries are never changed once they're in
+// the store, so a new one replaces it
+func (c *apiCache) refresh(key cacheKey, purges uint64, stale *cacheEntry, resp *http.Response) (*cacheEntry, error) {
+	if _, err := os.Stat(c.path(key)); err != nil {
+		return nil, err
+	}
 
-	if err := resp.Write(out); err != nil {
+	e := &cacheEntry{
+		responseTime: time.Now(),
+		maxAge:       calcMaxAge(resp),
+		etag:         stale.etag,
+		header:       make(http.Header),
+	}
+	for name, values := range stale.header {
+		e.header[name] = values
+	}
+	for _, name := range revalidatedHeaders {
+		if v := resp.Header.Get(name); v != "" {
+			e.header.Set(name, v)
+		}
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		e.etag = etag
+	}
+
+	if err := c.saveMeta(key, e); err != nil {
 		return nil, err
 	}
 
-	c.store[target] = e
+	c.mu.Lock()
+	if c.purges[key.owner] != purges {
+		c.mu.Unlock()
+		return nil, errors.New("Purged while fetching")
+	}
+	c.store[key] = e
+	c.mu.Unlock()
+	c.metrics.revalidation()
+	logger.Debug("Revalidated cache entry", "target", key.target, "owner", key.owner, "fresh_for", e.tilStale())
 	return e, nil
 }
 
-func constructResponse(target string, entry *cacheEntry) (*http.Response, error) {
-	path := cachePath(target)
-	log.Printf("Getting body of %s from %s", target, path)
-	body, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// get gives the response for target, from the cache if it's fresh.
+// owner is empty if the response is the same for everyone, or the
+// character ID if it depends on the client's token. Concurrent misses
+// for the same target and owner share one upstream request
+func (c *apiCache) get(client *http.Client, owner string, target string) (*http.Response, error) {
+	key := cacheKey{owner: owner, target: target}
+
+	c.mu.Lock()
+	entry, ok := c.store[key]
+	switch {
+	case !ok:
+		c.metrics.cacheResult(cacheMiss)
+	case !entry.fresh():
+		c.metrics.cacheResult(cacheStale)
+	default:
+		c.metrics.cacheResult(cacheHit)
+	}
+	if ok && entry.fresh() {
+		c.mu.Unlock()
+		logger.Debug("Serving from cache", "target", target, "owner", owner, "fresh_for", entry.tilStale())
+		resp, err := c.constructResponse(key, entry)
+		if err == nil {
+			return resp, nil
+		}
+		logger.Warn("Can't read cached response, fetching it again", "target", target, "owner", owner, "err", err)
+		c.mu.Lock()
+		if c.store[key] == entry {
+			delete(c.store, key)
+		}
+		ok = false
+	}
+
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		logger.Debug("Waiting for fetch", "target", target, "owner", owner)
+		<-cl.done
+		return c.callResponse(key, cl)
 	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	purges := c.purges[owner]
+	c.mu.Unlock()
 
-	return http.ReadResponse(bufio.NewReader(body), nil)
+	var stale *cacheEntry
+	if ok {
+		stale = entry
+	}
+	cl.raw, cl.entry, cl.err = c.fetch(client, key, purges, stale)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(cl.done)
+	return c.callResponse(key, cl)
 }
 
-func (c *apiCache) get(client *http.Client, target string) (*http.Response, error) {
-	entry, ok := c.store[target]
-	if !ok || !entry.fresh() {
+// fetch gets a target from upstream, and caches the response if it can.
+// If there's a stale entry with an ETag, ESI is asked whether it's
+// changed, and if it hasn't the refreshed entry is returned instead
+func (c *apiCache) fetch(client *http.Client, key cacheKey, purges uint64, stale *cacheEntry) ([]byte, *cacheEntry, error) {
+	req, err := http.NewRequest("GET", key.target, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	revalidating := stale != nil && stale.etag != ""
+	if revalidating {
+		req.Header.Set("If-None-Match", stale.etag)
+	}
 
-		resp, err := client.Get(target)
-		if err != nil {
-			return resp, err
-		}
-		entry, err = c.put(target, resp)
-		if err != nil {
-			log.Print("WARN: Couldn't store to cache: ", err)
-			return resp, nil
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if revalidating && resp.StatusCode == http.StatusNotModified {
+		e, err := c.refresh(key, purges, stale, resp)
+		if err == nil {
+			return nil, e, nil
 		}
+		logger.Warn("Can't revalidate cache entry, fetching it again", "target", key.target, "owner", key.owner, "err", err)
+		return c.fetch(client, key, purges, nil)
+	}
+
+	var raw bytes.Buffer
+	if err := resp.Write(&raw); err != nil {
+		return nil, nil, err
+	}
+	if err := c.put(key, purges, resp, raw.Bytes()); err != nil {
+		logger.Warn("Couldn't store to cache", "target", key.target, "owner", key.owner, "err", err)
+	}
+	return raw.Bytes(), nil, nil
+}
+
+// purge forgets everything cached for owner, and deletes the files
+func (c *apiCache) purge(owner string) error {
+	if owner == "" {
+		return errors.New("Refusing to purge the public cache")
 	}
 
-	log.Printf("Serving %s from cache (%s left)", target, entry.tilStale())
-	return constructResponse(target, entry)
+	c.mu.Lock()
+	c.purges[owner]++
+	for key := range c.store {
+		if key.owner == owner {
+			delete(c.store, key)
+		}
+	}
+	c.memory.removeOwner(owner)
+	c.mu.Unlock()
 
+	logger.Info("Purging cache", "owner", owner)
+	return os.RemoveAll(c.ownerDir(owner))
 }
@@ -0,0 +1,474 @@
+package eveapi
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Big enough for every response in the tests
+const testMemory = 1 << 20
+
+// upstream is a fake ESI that blocks every request until release is
+// closed, and counts them
+type upstream struct {
+	calls   int32
+	release chan struct{}
+	expires time.Duration
+	err     error
+}
+
+func (u *upstream) client() *http.Client {
+	return &http.Client{Transport: fakeTransport(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&u.calls, 1)
+		<-u.release
+		if u.err != nil {
+			return nil, u.err
+		}
+		now := time.Now()
+		h := make(http.Header)
+		h.Set("Date", now.Format(http.TimeFormat))
+		if u.expires > 0 {
+			h.Set("Expires", now.Add(u.expires).Format(http.TimeFormat))
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        h,
+			Body:          io.NopCloser(strings.NewReader("hello " + r.URL.Path)),
+			ContentLength: -1,
+		}, nil
+	})}
+}
+
+// getAll makes n concurrent requests for target, and waits until they
+// have all looked in the cache before letting upstream answer
+func getAll(t *testing.T, c *apiCache, u *upstream, target string, n int) ([]string, []error) {
+	t.Helper()
+	bodies := make([]string, n)
+	errs := make([]error, n)
+	client := u.client()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := c.get(client, "", target)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			bodies[i], errs[i] = string(b), err
+		}(i)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		c.metrics.mu.Lock()
+		looked := c.metrics.cache[cacheMiss] + c.metrics.cache[cacheStale] + c.metrics.cache[cacheHit]
+		c.metrics.mu.Unlock()
+		if looked >= uint64(n) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for requests")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(u.release)
+	wg.Wait()
+	return bodies, errs
+}
+
+func TestCacheCoalesces(t *testing.T) {
+	c := newAPICache(t.TempDir(), testMemory, newMetrics())
+	u := &upstream{release: make(chan struct{}), expires: time.Minute}
+	target := apiURL + "/characters/1/"
+
+	bodies, errs := getAll(t, c, u, target, 20)
+	for i := range bodies {
+		if errs[i] != nil || bodies[i] != "hello /characters/1/" {
+			t.Errorf("%d: got %q, %v", i, bodies[i], errs[i])
+		}
+	}
+	if u.calls != 1 {
+		t.Errorf("Expected one upstream request, got %d", u.calls)
+	}
+
+	// Now it's cached
+	resp, err := c.get(u.client(), "", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if u.calls != 1 || c.metrics.cache[cacheHit] != 1 {
+		t.Errorf("Expected a cache hit, got %d calls and %v", u.calls, c.metrics.cache)
+	}
+}
+
+func TestCacheUncacheable(t *testing.T) {
+	c := newAPICache(t.TempDir(), testMemory, newMetrics())
+	u := &upstream{release: make(chan struct{})}
+	target := apiURL + "/status/"
+
+	// Everyone waiting still gets the response, even though it can't be
+	// cached
+	bodies, errs := getAll(t, c, u, target, 10)
+	for i := range bodies {
+		if errs[i] != nil || bodies[i] != "hello /status/" {
+			t.Errorf("%d: got %q, %v", i, bodies[i], errs[i])
+		}
+	}
+	if u.calls != 1 {
+		t.Errorf("Expected one upstream request, got %d", u.calls)
+	}
+
+	resp, err := c.get(u.client(), "", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if u.calls != 2 {
+		t.Errorf("Expected another upstream request, got %d", u.calls)
+	}
+}
+
+func TestCacheError(t *testing.T) {
+	c := newAPICache(t.TempDir(), testMemory, newMetrics())
+	u := &upstream{release: make(chan struct{}), err: errors.New("connection refused")}
+
+	_, errs := getAll(t, c, u, apiURL+"/broken/", 10)
+	for i, err := range errs {
+		if err == nil || !strings.Contains(err.Error(), "connection refused") {
+			t.Errorf("%d: expected the upstream error, got %v", i, err)
+		}
+	}
+	if u.calls != 1 {
+		t.Errorf("Expected one upstream request, got %d", u.calls)
+	}
+	if len(c.calls) != 0 {
+		t.Errorf("Expected no fetches left, got %d", len(c.calls))
+	}
+}
+
+func TestCacheOwners(t *testing.T) {
+	dir := t.TempDir()
+	c := newAPICache(dir, testMemory, newMetrics())
+	u := &upstream{release: make(chan struct{}), expires: time.Minute}
+	close(u.release)
+	target := apiURL + "/latest/characters/1/assets/"
+
+	for _, owner := range []string{"1", "2", "1", "2", ""} {
+		resp, err := c.get(u.client(), owner, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if u.calls != 3 {
+		t.Errorf("Expected one upstream request per owner, got %d", u.calls)
+	}
+
+	hash := stringHash(target)
+	for _, p := range []string{"public/" + hash, "characters/1/" + hash, "characters/2/" + hash} {
+		if _, err := os.Stat(filepath.Join(dir, p)); err != nil {
+			t.Errorf("Expected %s: %v", p, err)
+		}
+	}
+
+	if err := c.purge("1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "characters", "1")); !os.IsNotExist(err) {
+		t.Errorf("Expected character 1's responses to be gone, got %v", err)
+	}
+	for _, owner := range []string{"1", "2"} {
+		resp, err := c.get(u.client(), owner, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if u.calls != 4 {
+		t.Errorf("Expected a new request for character 1 only, got %d", u.calls)
+	}
+
+	if err := c.purge(""); err == nil {
+		t.Error("Expected an error purging the public cache")
+	}
+}
+
+func TestCacheOwner(t *testing.T) {
+	user := &User{ID: 42}
+	tests := []struct {
+		path  string
+		owner string
+		ok    bool
+	}{
+		{"/latest/markets/prices", "", true},
+		{"/latest/markets/prices/?datasource=tranquility", "", true},
+		{"/v1/universe/types/34/", "", true},
+		{"/latest/markets/10000002/orders/", "", true},
+		{"/latest/characters/42/assets/", "42", true},
+		{"/latest/characters/42/", "42", true},
+		{"/latest/universe/../characters/42/assets/", "42", true},
+		{"/latest/universe%2f..%2fcharacters/42/", "42", true},
+		{"/latest/universes/", "42", true},
+		{"/verify", "42", true},
+		{"/latest/universe/structures/", "", true},
+		{"/latest/alliances/99000001/", "", true},
+		{"/latest/universe/structures/1021975535893/", "42", true},
+		{"/latest/alliances/99000001/contacts/", "42", true},
+		{"/v2/alliances/99000001/contacts/labels/", "42", true},
+		{"/latest/markets/structures/1021975535893/", "42", true},
+		{"/latest/universe/types/34/extra/", "42", true},
+	}
+	for _, tc := range tests {
+		owner, ok := cacheOwner(user, tc.path)
+		if owner != tc.owner || ok != tc.ok {
+			t.Errorf("%s: expected %q %v, got %q %v", tc.path, tc.owner, tc.ok, owner, ok)
+		}
+	}
+
+	// Before login, the character isn't known
+	if _, ok := cacheOwner(&User{}, "/verify"); ok {
+		t.Error("Expected /verify to be uncacheable before the character is known")
+	}
+	if owner, ok := cacheOwner(&User{}, "/latest/status/"); owner != "" || !ok {
+		t.Error("Expected public routes to be cacheable before the character is known")
+	}
+}
+
+// etagUpstream is a fake ESI that answers 304 when If-None-Match has the
+// current ETag
+type etagUpstream struct {
+	calls int
+	body  string
+	etags []string
+}
+
+func (u *etagUpstream) client() *http.Client {
+	return &http.Client{Transport: fakeTransport(func(r *http.Request) (*http.Response, error) {
+		u.calls++
+		u.etags = append(u.etags, r.Header.Get("If-None-Match"))
+		now := time.Now()
+		h := make(http.Header)
+		h.Set("Date", now.Format(http.TimeFormat))
+		// so each response expires later than the last
+		h.Set("Expires", now.Add(time.Duration(u.calls)*time.Minute).Format(http.TimeFormat))
+		h.Set("ETag", `"`+u.body+`"`)
+		resp := &http.Response{ProtoMajor: 1, ProtoMinor: 1, Header: h, Body: io.NopCloser(strings.NewReader(""))}
+		if r.Header.Get("If-None-Match") == `"`+u.body+`"` {
+			resp.StatusCode = http.StatusNotModified
+		} else {
+			resp.StatusCode = http.StatusOK
+			resp.Body = io.NopCloser(strings.NewReader(u.body))
+			resp.ContentLength = int64(len(u.body))
+		}
+		return resp, nil
+	})}
+}
+
+func TestCacheRevalidates(t *testing.T) {
+	c := newAPICache(t.TempDir(), testMemory, newMetrics())
+	u := &etagUpstream{body: "v1"}
+	target := apiURL + "/latest/markets/prices"
+	key := cacheKey{target: target}
+
+	get := func() (string, http.Header) {
+		t.Helper()
+		resp, err := c.get(u.client(), "", target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b), resp.Header
+	}
+	expire := func() {
+		c.store[key].responseTime = time.Now().Add(-time.Hour)
+	}
+
+	get()
+	expire()
+	body, h := get()
+	if body != "v1" || u.calls != 2 || u.etags[1] != `"v1"` {
+		t.Errorf("Expected a revalidated v1, got %q after %d calls with %q", body, u.calls, u.etags)
+	}
+	if exp, err := http.ParseTime(h.Get("Expires")); err != nil || exp.Before(time.Now().Add(90*time.Second)) {
+		t.Errorf("Expected a new Expires, got %q", h.Get("Expires"))
+	}
+	if c.metrics.revalidations != 1 {
+		t.Errorf("Expected a revalidation, got %d", c.metrics.revalidations)
+	}
+	if body, _ := get(); body != "v1" || u.calls != 2 {
+		t.Errorf("Expected a cache hit, got %q after %d calls", body, u.calls)
+	}
+
+	// Changed upstream
+	u.body = "v2"
+	expire()
+	if body, h := get(); body != "v2" || h.Get("ETag") != `"v2"` || u.calls != 3 {
+		t.Errorf("Expected v2, got %q %q after %d calls", body, h.Get("ETag"), u.calls)
+	}
+
+	// The saved response has gone missing, so the 304 isn't any use
+	expire()
+	os.Remove(c.path(key))
+	if body, _ := get(); body != "v2" || u.calls != 5 || u.etags[4] != "" {
+		t.Errorf("Expected a fresh v2, got %q after %d calls with %q", body, u.calls, u.etags)
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		inm, etag string
+		match     bool
+	}{
+		{`"a"`, `"a"`, true},
+		{`"b", "a"`, `"a"`, true},
+		{`W/"a"`, `"a"`, true},
+		{`"a"`, `W/"a"`, true},
+		{`*`, `"a"`, true},
+		{`"b"`, `"a"`, false},
+		{``, `"a"`, false},
+		{`*`, ``, false},
+	}
+	for _, tc := range tests {
+		if got := etagMatches(tc.inm, tc.etag); got != tc.match {
+			t.Errorf("%q %q: expected %v", tc.inm, tc.etag, tc.match)
+		}
+	}
+}
+
+func TestCacheLoad(t *testing.T) {
+	dir := t.TempDir()
+	u := &etagUpstream{body: "v1"}
+	target := apiURL + "/latest/characters/1/assets/"
+
+	c := newAPICache(dir, testMemory, newMetrics())
+	resp, err := c.get(u.client(), "1", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// A new run finds it
+	c = newAPICache(dir, testMemory, newMetrics())
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = c.get(u.client(), "1", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if string(b) != "v1" || u.calls != 1 {
+		t.Errorf("Expected v1 from the cache, got %q after %d calls", b, u.calls)
+	}
+	if e := c.store[cacheKey{owner: "1", target: target}]; e == nil || e.etag != `"v1"` {
+		t.Errorf("Wrong entry: %+v", e)
+	}
+
+	// Entries without their response are skipped
+	os.Remove(c.path(cacheKey{owner: "1", target: target}))
+	c = newAPICache(dir, testMemory, newMetrics())
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.store) != 0 {
+		t.Errorf("Expected no entries, got %d", len(c.store))
+	}
+}
+
+// openFiles counts this process's open files, or gives -1 if it can't
+func openFiles() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+func TestCacheHits(t *testing.T) {
+	if openFiles() < 0 {
+		t.Skip("Can't count open files")
+	}
+	u := &etagUpstream{body: "v1"}
+	target := apiURL + "/latest/markets/prices"
+
+	for _, memory := range []int64{0, testMemory} {
+		c := newAPICache(t.TempDir(), memory, newMetrics())
+		before := openFiles()
+		for i := 0; i < 100; i++ {
+			resp, err := c.get(u.client(), "", target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(b) != "v1" {
+				t.Fatalf("Expected v1, got %q", b)
+			}
+		}
+		if after := openFiles(); after > before+2 {
+			t.Errorf("memory %d: %d files open before, %d after", memory, before, after)
+		}
+
+		expected := uint64(99)
+		if memory == 0 {
+			expected = 0
+		}
+		if c.metrics.memoryHits != expected {
+			t.Errorf("memory %d: expected %d memory hits, got %d", memory, expected, c.metrics.memoryHits)
+		}
+	}
+}
+
+func TestCachePurgeDuringFetch(t *testing.T) {
+	dir := t.TempDir()
+	c := newAPICache(dir, testMemory, newMetrics())
+	u := &upstream{release: make(chan struct{}), expires: time.Minute}
+	target := apiURL + "/latest/characters/1/assets/"
+
+	done := make(chan error)
+	go func() {
+		resp, err := c.get(u.client(), "1", target)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	for atomic.LoadInt32(&u.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := c.purge("1"); err != nil {
+		t.Fatal(err)
+	}
+	close(u.release)
+
+	// The character that asked still gets an answer, but nothing is kept
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(c.store) != 0 {
+		t.Errorf("Expected nothing cached, got %d entries", len(c.store))
+	}
+	if _, ok := c.memory.get(cacheKey{owner: "1", target: target}); ok {
+		t.Error("Expected nothing in memory")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "characters", "1")); !os.IsNotExist(err) {
+		t.Errorf("Expected character 1's directory to be gone, got %v", err)
+	}
+}
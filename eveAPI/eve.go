@@ -9,9 +9,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"golang.org/x/oauth2"
@@ -19,18 +22,55 @@ import (
 
 const apiURL = "https://esi.evetech.net"
 
+// logger is used for everything the package logs
+var logger = slog.Default()
+
+// SetLogger sets the logger used by the eveapi package
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
 var interestingHeaders = []string{"Content-Type", "Content-Length", "Cache-Control", "ETag", "Expires", "Last-Modified", "X-Pages"}
 
+// Paths says where the eve package keeps its files
+type Paths struct {
+	// Config is the JSON file with the ESI application details
+	Config string
+	// Data is the static data export, with fsd and bsd directories
+	Data string
+	// Users is the file logged in characters are saved to
+	Users string
+	// Cache is the directory ESI responses are cached in
+	Cache string
+}
+
+// DefaultPaths puts everything in dir: config.json, data, users/cache
+// and cache
+func DefaultPaths(dir string) Paths {
+	return Paths{
+		Config: filepath.Join(dir, "config.json"),
+		Data:   filepath.Join(dir, "data"),
+		Users:  filepath.Join(dir, "users", "cache"),
+		Cache:  filepath.Join(dir, "cache"),
+	}
+}
+
 // Eve holds state for the Eve API
 type Eve struct {
+	paths      Paths
 	conf       Config
 	oauth      *oauth2.Config
 	users      *UserCache
 	apiCache   *apiCache
+	metrics    *metrics
 	types      eveTypes
 	attributes eveAttributes
 	blueprints eveBlueprints
 	groups     eveGroups
+
+	// closed to stop the janitor, which closes janitorDone
+	stop        chan struct{}
+	janitorDone chan struct{}
 }
 
 // Config holds configuration details
@@ -38,6 +78,11 @@ type Config struct {
 	ClientID    string
 	Secret      string
 	RedirectURL string
+	// MaxCacheMB is how big the ESI cache can get. Defaults to 256
+	MaxCacheMB int64
+	// MaxMemoryMB is how much of the ESI cache is kept in memory.
+	// Defaults to 32
+	MaxMemoryMB int64
 }
 
 // Originally from https://stackoverflow.com/a/50581165/195833
@@ -66,29 +111,91 @@ func getAPIPath(path string) string {
 	return fmt.Sprintf("%s%s", apiURL, path)
 }
 
+// ESI operations that don't need a token, so give the same response to
+// everyone. This is a list of operations rather than whole trees because
+// some, like /universe/structures/{id}/ and /alliances/{id}/contacts/,
+// do need one. Anything that isn't here is cached per character
+var publicOperations = []string{
+	`status`,
+	`universe/(?:types|groups|categories|regions|constellations|systems|stations|planets|moons|stargates|stars|asteroid_belts|graphics|schematics)(?:/[0-9]+)?`,
+	`universe/(?:races|factions|bloodlines|ancestries|system_jumps|system_kills|structures)`,
+	`markets/prices`,
+	`markets/groups(?:/[0-9]+)?`,
+	`markets/[0-9]+/(?:orders|history|types)`,
+	`industry/(?:systems|facilities)`,
+	`insurance/prices`,
+	`alliances(?:/[0-9]+(?:/corporations|/icons)?)?`,
+	`sovereignty/(?:campaigns|map|structures)`,
+}
+
+var publicRoutes = regexp.MustCompile(`^/(?:latest|dev|legacy|v[0-9]+)/(?:` + strings.Join(publicOperations, "|") + `)/?$`)
+
+// cacheOwner says who the response for path belongs to in the cache:
+// empty for public routes, or u's character ID. ok is false if the
+// response can't be cached, because the character isn't known yet
+func cacheOwner(u *User, path string) (string, bool) {
+	p := path
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	// Anything that might not mean what it looks like is private
+	if publicRoutes.MatchString(p) && !strings.Contains(p, "..") && !strings.ContainsAny(p, "%\\") {
+		return "", true
+	}
+	if u.ID == 0 {
+		return "", false
+	}
+	return strconv.Itoa(int(u.ID)), true
+}
+
 func (e *Eve) apiGet(u *User, path string) (*http.Response, error) {
-	log.Printf("EVE API GET %s", path)
-	return e.apiCache.get(e.makeClient(u), getAPIPath(path))
+	logger.Debug("API GET", "path", path)
+	owner, ok := cacheOwner(u, path)
+	if !ok {
+		return e.makeClient(u).Get(getAPIPath(path))
+	}
+	return e.apiCache.get(e.makeClient(u), owner, getAPIPath(path))
 }
 
 func (e *Eve) apiPost(u *User, path string, body io.ReadCloser) (*http.Response, error) {
-	log.Printf("EVE API POST %s", path)
+	logger.Debug("API POST", "path", path)
 	return e.makeClient(u).Post(getAPIPath(path), "application/json", body)
 }
 
-// NewEve creates a new eve
-func NewEve() *Eve {
-	e := Eve{}
+// NewEve creates a new eve, with its files in paths
+func NewEve(paths Paths) *Eve {
+	e := Eve{paths: paths}
 	err := e.readConfig()
 	if err != nil {
-		log.Fatal("Can't read eve config:", err)
+		logger.Error("Can't read eve config", "err", err)
+		os.Exit(1)
 	}
 
 	if err := e.loadStatic(); err != nil {
-		log.Fatal("Can't load eve static data")
+		logger.Error("Can't load eve static data", "err", err)
+		os.Exit(1)
 	}
 
-	e.apiCache = newAPICache()
+	e.metrics = newMetrics()
+	for _, dir := range []string{paths.Cache, filepath.Dir(paths.Users)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			logger.Error("Can't create directory", "dir", dir, "err", err)
+			os.Exit(1)
+		}
+	}
+	if e.conf.MaxCacheMB <= 0 {
+		e.conf.MaxCacheMB = defaultMaxCacheMB
+	}
+	if e.conf.MaxMemoryMB <= 0 {
+		e.conf.MaxMemoryMB = defaultMaxMemoryMB
+	}
+	e.apiCache = newAPICache(paths.Cache, e.conf.MaxMemoryMB<<20, e.metrics)
+	if err := e.apiCache.load(); err != nil {
+		logger.Warn("Problem loading the ESI cache", "err", err)
+	}
+	e.stop = make(chan struct{})
+	e.janitorDone = make(chan struct{})
+	go e.apiCache.janitor(e.conf.MaxCacheMB<<20, e.stop, e.janitorDone)
 
 	e.oauth = &oauth2.Config{
 		ClientID:     e.conf.ClientID,
@@ -101,18 +208,18 @@ func NewEve() *Eve {
 		RedirectURL: e.conf.RedirectURL,
 	}
 
-	u, err := readUserCache("users/cache")
+	u, err := readUserCache(paths.Users)
 	if err == nil {
 		e.users = u
 	} else {
-		log.Printf("Problem reading the user cache")
+		logger.Warn("Problem reading the user cache", "err", err)
 	}
 	return &e
 }
 
 func (e *Eve) readConfig() error {
 
-	raw, err := ioutil.ReadFile("../eveAPI/config.json")
+	raw, err := ioutil.ReadFile(e.paths.Config)
 	if err != nil {
 		return err
 	}
@@ -125,7 +232,7 @@ func (e *Eve) readConfig() error {
 }
 
 func (e *Eve) makeClient(u *User) *http.Client {
-	return e.oauth.Client(context.Background(), u.Token)
+	return e.oauth.Client(e.clientContext(), u.Token)
 }
 
 func (e *Eve) getAuthURL(state string) string {
@@ -146,6 +253,62 @@ func (e *Eve) getUser(r *http.Request) (*User, error) {
 	return user, nil
 }
 
+// LogFields gives the logged in character for r, if there is one,
+// for adding to the access log
+func (e *Eve) LogFields(r *http.Request) []slog.Attr {
+	if e.users == nil {
+		return nil
+	}
+	user, err := e.getUser(r)
+	if err != nil {
+		return nil
+	}
+	return []slog.Attr{
+		slog.Int("character_id", int(user.ID)),
+		slog.String("character", user.Name),
+	}
+}
+
+// UserKey gives the logged in character's ID for r, or an empty string
+// for anonymous requests. Used to rate limit by character
+func (e *Eve) UserKey(r *http.Request) string {
+	if e.users == nil {
+		return ""
+	}
+	user, err := e.getUser(r)
+	if err != nil {
+		return ""
+	}
+	return strconv.Itoa(int(user.ID))
+}
+
+// Ready reports whether the static data is loaded and the user cache
+// can be read, for readiness checks
+func (e *Eve) Ready() error {
+	if len(e.types) == 0 || len(e.blueprints) == 0 || len(e.groups) == 0 {
+		return errors.New("Static data not loaded")
+	}
+	if e.users == nil {
+		return errors.New("User cache not loaded")
+	}
+	return e.users.readable()
+}
+
+// Shutdown stops cleaning the cache and waits for users to be saved.
+// It can be passed to server.AddShutdownHook
+func (e *Eve) Shutdown(ctx context.Context) error {
+	close(e.stop)
+	select {
+	case <-e.janitorDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if e.users != nil {
+		e.users.flush()
+	}
+	return nil
+}
+
 func (e *Eve) handleLogin(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
@@ -212,6 +375,50 @@ func (e *Eve) handleAuthCallback(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(302)
 }
 
+// handleLogout forgets the logged in character, and everything cached
+// for them
+func (e *Eve) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, 405, "Method not allowed", nil)
+		return
+	}
+	user, err := e.getUser(r)
+	if err != nil {
+		writeError(w, 400, "Not logged in", err)
+		return
+	}
+
+	authCookie, _ := r.Cookie("state")
+	e.users.remove(authCookie.Value)
+	if err := e.apiCache.purge(strconv.Itoa(int(user.ID))); err != nil {
+		logger.Warn("Can't purge cache", "character_id", user.ID, "err", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "state",
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+	w.WriteHeader(204)
+}
+
+// etagMatches reports whether an If-None-Match header matches etag.
+// Weak and strong tags match each other, as they should for GET
+func etagMatches(ifNoneMatch, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *Eve) handleAPI(w http.ResponseWriter, r *http.Request) {
 	user, err := e.getUser(r)
 	if err != nil {
@@ -228,13 +435,14 @@ func (e *Eve) handleAPI(w http.ResponseWriter, r *http.Request) {
 	}
 	method := param.Get("m")
 
+	isGet := len(method) == 0 || method == "GET"
+
 	var resp *http.Response
-	if len(method) == 0 || method == "GET" {
+	if isGet {
 		resp, err = e.apiGet(user, target)
 	} else if method == "POST" {
-		log.Println("EVE: Starting post")
 		resp, err = e.apiPost(user, target, r.Body)
-		log.Println("EVE: Post complete")
+		logger.Debug("Post complete", "path", target)
 	}
 
 	if err != nil {
@@ -247,6 +455,12 @@ func (e *Eve) handleAPI(w http.ResponseWriter, r *http.Request) {
 	for _, name := range interestingHeaders {
 		w.Header().Set(name, resp.Header.Get(name))
 	}
+	if isGet && resp.StatusCode == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), resp.Header.Get("ETag")) {
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	w.WriteHeader(resp.StatusCode)
 	io.Copy(w, resp.Body)
 
@@ -254,16 +468,19 @@ func (e *Eve) handleAPI(w http.ResponseWriter, r *http.Request) {
 
 func (e *Eve) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(r.URL.Path, "/eveapi/auth2") {
-		log.Print("EVE: Handing to auth callback")
+		logger.Debug("Handing to auth callback")
 		e.handleAuthCallback(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/eveapi/logout") {
+		logger.Debug("Handing to logout")
+		e.handleLogout(w, r)
 	} else if strings.HasPrefix(r.URL.Path, "/eveapi/api") {
-		log.Print("EVE: Handing to API")
+		logger.Debug("Handing to API")
 		e.handleAPI(w, r)
 	} else if strings.HasPrefix(r.URL.Path, "/eveapi/static") {
-		log.Print("EVE: Handing to Static")
+		logger.Debug("Handing to static")
 		e.handleStatic(w, r)
 	} else {
-		log.Print("EVE: Sending user data")
+		logger.Debug("Sending user data")
 		e.handleLogin(w, r)
 	}
 }
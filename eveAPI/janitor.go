@@ -0,0 +1,154 @@
+package eveapi
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// How often the janitor cleans the cache
+	janitorInterval = 10 * time.Minute
+	// Stale entries with an ETag are kept this long after they expire,
+	// in case ESI says they haven't changed
+	keepStale = 24 * time.Hour
+	// Files that don't belong to an entry are left alone until they're
+	// this old, in case they're still being written
+	orphanAge = time.Minute
+	// Used when the config doesn't give a maximum size
+	defaultMaxCacheMB = 256
+)
+
+// janitor cleans the cache now, and then every janitorInterval, until
+// stop is closed. It closes done when it has finished
+func (c *apiCache) janitor(maxSize int64, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.clean(maxSize); err != nil {
+			logger.Warn("Can't clean cache", "err", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expired reports whether an entry isn't worth keeping
+func (e *cacheEntry) expired() bool {
+	if e.fresh() {
+		return false
+	}
+	return e.etag == "" || -e.tilStale() > keepStale
+}
+
+// clean deletes expired entries and files that don't belong to an entry,
+// and then the oldest entries until the cache fits in maxSize bytes
+func (c *apiCache) clean(maxSize int64) error {
+	c.mu.Lock()
+	entries := make(map[cacheKey]*cacheEntry, len(c.store))
+	for key, e := range c.store {
+		entries[key] = e
+	}
+	c.mu.Unlock()
+
+	expired := 0
+	for key, e := range entries {
+		if e.expired() {
+			// Entries that couldn't go still own their files
+			if c.evict(key, e) {
+				delete(entries, key)
+				expired++
+			}
+		}
+	}
+
+	// Everything else on disk should belong to an entry
+	owners := make(map[string]cacheKey, 2*len(entries))
+	for key := range entries {
+		owners[c.path(key)] = key
+		owners[c.metaPath(key)] = key
+	}
+	sizes := make(map[cacheKey]int64, len(entries))
+	orphans := 0
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == c.dir {
+				return err
+			}
+			logger.Warn("Can't check cache file", "path", path, "err", err)
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Warn("Can't check cache file", "path", path, "err", err)
+			}
+			return nil
+		}
+		if key, ok := owners[path]; ok {
+			sizes[key] += info.Size()
+			return nil
+		}
+		if time.Since(info.ModTime()) < orphanAge {
+			return nil
+		}
+		logger.Debug("Removing orphaned cache file", "path", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Warn("Can't remove orphaned cache file", "path", path, "err", err)
+		}
+		orphans++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	keys := make([]cacheKey, 0, len(sizes))
+	for key, size := range sizes {
+		total += size
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return entries[keys[i]].responseTime.Before(entries[keys[j]].responseTime)
+	})
+	evicted := 0
+	for _, key := range keys {
+		if total <= maxSize {
+			break
+		}
+		if c.evict(key, entries[key]) {
+			total -= sizes[key]
+			evicted++
+		}
+	}
+
+	logger.Info("Cleaned cache", "expired", expired, "orphans", orphans, "evicted", evicted, "bytes", total)
+	return nil
+}
+
+// evict removes an entry and its files, unless the entry has been
+// replaced since the janitor looked at it or is being fetched again.
+// Fetches write their files before they take the lock, so the files are
+// removed with it held, and only when there's no fetch to race with
+func (c *apiCache) evict(key cacheKey, e *cacheEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, fetching := c.calls[key]; fetching || c.store[key] != e {
+		return false
+	}
+	delete(c.store, key)
+	c.memory.remove(key)
+	c.removeFiles(key)
+	return true
+}
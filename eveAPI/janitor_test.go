@@ -0,0 +1,117 @@
+package eveapi
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClean(t *testing.T) {
+	dir := t.TempDir()
+	c := newAPICache(dir, testMemory, newMetrics())
+	etags := &etagUpstream{body: "v1"}
+	plain := &upstream{release: make(chan struct{}), expires: time.Minute}
+	close(plain.release)
+
+	fill := func(u interface{ client() *http.Client }, name string, age time.Duration) cacheKey {
+		t.Helper()
+		key := cacheKey{owner: "1", target: apiURL + "/" + name}
+		resp, err := c.get(u.client(), key.owner, key.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		c.store[key].responseTime = time.Now().Add(-age)
+		return key
+	}
+	fresh := fill(etags, "fresh", 0)
+	older := fill(etags, "older", time.Second)
+	expired := fill(plain, "expired", time.Hour)
+	stale := fill(etags, "stale", time.Hour)
+	tooStale := fill(etags, "too-stale", 2*keepStale)
+
+	old := time.Now().Add(-time.Hour)
+	orphan := filepath.Join(dir, "from-an-old-version")
+	recent := filepath.Join(dir, "public", tempPrefix+"being-written")
+	os.MkdirAll(filepath.Dir(recent), 0700)
+	for _, p := range []string{orphan, recent} {
+		os.WriteFile(p, []byte("x"), 0600)
+	}
+	os.Chtimes(orphan, old, old)
+
+	// Big enough for three entries
+	var size int64
+	for _, key := range []cacheKey{fresh, stale, older} {
+		for _, p := range []string{c.path(key), c.metaPath(key)} {
+			info, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size += info.Size()
+		}
+	}
+	if err := c.clean(size); err != nil {
+		t.Fatal(err)
+	}
+	check := func(kept []cacheKey, gone []cacheKey) {
+		t.Helper()
+		for _, key := range kept {
+			if _, ok := c.store[key]; !ok {
+				t.Errorf("Expected %s to be kept", key.target)
+			}
+			if _, err := os.Stat(c.metaPath(key)); err != nil {
+				t.Errorf("Expected %s's files to be kept", key.target)
+			}
+		}
+		for _, key := range gone {
+			if _, ok := c.store[key]; ok {
+				t.Errorf("Expected %s to be removed", key.target)
+			}
+			if _, err := os.Stat(c.path(key)); !os.IsNotExist(err) {
+				t.Errorf("Expected %s's files to be removed", key.target)
+			}
+		}
+	}
+	check([]cacheKey{fresh, older, stale}, []cacheKey{expired, tooStale})
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("Expected the orphan to be removed")
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Error("Expected the file being written to be kept")
+	}
+
+	// Too big now, so the oldest goes first
+	if err := c.clean(size - 1); err != nil {
+		t.Fatal(err)
+	}
+	check([]cacheKey{fresh, older}, []cacheKey{stale})
+
+	// Entries being fetched again are left for the fetch to replace
+	c.store[older].responseTime = time.Now().Add(-2 * keepStale)
+	c.calls[older] = &call{done: make(chan struct{})}
+	if err := c.clean(size); err != nil {
+		t.Fatal(err)
+	}
+	check([]cacheKey{fresh, older}, nil)
+	delete(c.calls, older)
+	if err := c.clean(size); err != nil {
+		t.Fatal(err)
+	}
+	check([]cacheKey{fresh}, []cacheKey{older})
+}
+
+func TestJanitorStops(t *testing.T) {
+	c := newAPICache(t.TempDir(), testMemory, newMetrics())
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go c.janitor(1<<20, stop, done)
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Janitor didn't stop")
+	}
+}
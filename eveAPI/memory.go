@@ -0,0 +1,94 @@
+package eveapi
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Used when the config doesn't give a size for the memory cache
+const defaultMaxMemoryMB = 32
+
+// memoryCache keeps the most recently used responses in memory, up to
+// maxSize bytes, in front of the files on disk
+type memoryCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	// of *memoryItem, most recently used first
+	order *list.List
+	items map[cacheKey]*list.Element
+}
+
+type memoryItem struct {
+	key cacheKey
+	// the whole response, as written by http.Response.Write
+	raw []byte
+}
+
+func newMemoryCache(maxSize int64) *memoryCache {
+	return &memoryCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		items:   make(map[cacheKey]*list.Element),
+	}
+}
+
+// get gives the response for key, if it's in memory. It must not be
+// changed
+func (m *memoryCache) get(key cacheKey) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	return el.Value.(*memoryItem).raw, true
+}
+
+// add keeps a response in memory, replacing any older one for key, and
+// drops the least recently used ones until there's room
+func (m *memoryCache) add(key cacheKey, raw []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeLocked(key)
+	if int64(len(raw)) > m.maxSize {
+		return
+	}
+	m.items[key] = m.order.PushFront(&memoryItem{key: key, raw: raw})
+	m.size += int64(len(raw))
+
+	for m.size > m.maxSize {
+		m.removeLocked(m.order.Back().Value.(*memoryItem).key)
+	}
+}
+
+func (m *memoryCache) remove(key cacheKey) {
+	m.mu.Lock()
+	m.removeLocked(key)
+	m.mu.Unlock()
+}
+
+// removeOwner drops every response for owner
+func (m *memoryCache) removeOwner(owner string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key := range m.items {
+		if key.owner == owner {
+			m.removeLocked(key)
+		}
+	}
+}
+
+func (m *memoryCache) removeLocked(key cacheKey) {
+	el, ok := m.items[key]
+	if !ok {
+		return
+	}
+	m.order.Remove(el)
+	delete(m.items, key)
+	m.size -= int64(len(el.Value.(*memoryItem).raw))
+}
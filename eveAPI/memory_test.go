@@ -0,0 +1,53 @@
+package eveapi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemoryCache(t *testing.T) {
+	m := newMemoryCache(10)
+	key := func(target string) cacheKey { return cacheKey{target: target} }
+	has := func(targets string) {
+		t.Helper()
+		var got []string
+		for el := m.order.Front(); el != nil; el = el.Next() {
+			got = append(got, el.Value.(*memoryItem).key.target)
+		}
+		if strings.Join(got, ",") != targets {
+			t.Errorf("Expected %s, got %s", targets, strings.Join(got, ","))
+		}
+	}
+
+	m.add(key("a"), []byte("aaaa"))
+	m.add(key("b"), []byte("bbbb"))
+	has("b,a")
+
+	// Using a moves it to the front, so b goes first
+	if raw, ok := m.get(key("a")); !ok || string(raw) != "aaaa" {
+		t.Errorf("Expected a, got %q %v", raw, ok)
+	}
+	m.add(key("c"), []byte("cccc"))
+	has("c,a")
+	if _, ok := m.get(key("b")); ok {
+		t.Error("Expected b to be dropped")
+	}
+
+	// Replacing keeps the size right
+	m.add(key("a"), []byte("aa"))
+	if m.size != 6 {
+		t.Errorf("Expected 6 bytes, got %d", m.size)
+	}
+
+	// Too big to keep at all
+	m.add(key("d"), []byte("ddddddddddd"))
+	has("a,c")
+
+	m.add(cacheKey{owner: "1", target: "e"}, []byte("e"))
+	m.removeOwner("1")
+	m.remove(key("c"))
+	has("a")
+	if m.size != 2 || len(m.items) != 1 {
+		t.Errorf("Expected 2 bytes in 1 item, got %d in %d", m.size, len(m.items))
+	}
+}
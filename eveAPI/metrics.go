@@ -0,0 +1,157 @@
+package eveapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Upper bounds of the ESI latency buckets, in seconds
+var latencyBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Cache lookup results
+const (
+	cacheHit   = "hit"
+	cacheMiss  = "miss"
+	cacheStale = "stale"
+)
+
+// metrics counts what the cache and ESI are doing
+type metrics struct {
+	mu    sync.Mutex
+	cache map[string]uint64
+	// stale entries that ESI said hadn't changed
+	revalidations uint64
+	// hits that didn't need to read the disk
+	memoryHits uint64
+	errors     map[string]uint64
+	buckets    []uint64
+	count      uint64
+	sum        float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		cache:   map[string]uint64{cacheHit: 0, cacheMiss: 0, cacheStale: 0},
+		errors:  make(map[string]uint64),
+		buckets: make([]uint64, len(latencyBuckets)),
+	}
+}
+
+func (m *metrics) cacheResult(result string) {
+	m.mu.Lock()
+	m.cache[result]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) revalidation() {
+	m.mu.Lock()
+	m.revalidations++
+	m.mu.Unlock()
+}
+
+func (m *metrics) memoryHit() {
+	m.mu.Lock()
+	m.memoryHits++
+	m.mu.Unlock()
+}
+
+// upstream records an ESI request. status is zero if the request
+// failed without a response
+func (m *metrics) upstream(d time.Duration, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v := d.Seconds()
+	for i, b := range latencyBuckets {
+		if v <= b {
+			m.buckets[i]++
+			break
+		}
+	}
+	m.count++
+	m.sum += v
+
+	if status == 0 {
+		m.errors["none"]++
+	} else if status >= 400 {
+		m.errors[strconv.Itoa(status)]++
+	}
+}
+
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP eveapi_cache_requests_total ESI cache lookups, by result\n# TYPE eveapi_cache_requests_total counter\n")
+	for _, r := range []string{cacheHit, cacheMiss, cacheStale} {
+		fmt.Fprintf(w, "eveapi_cache_requests_total{result=%q} %d\n", r, m.cache[r])
+	}
+	fmt.Fprintf(w, "# HELP eveapi_cache_revalidations_total Stale ESI cache entries that hadn't changed\n# TYPE eveapi_cache_revalidations_total counter\n")
+	fmt.Fprintf(w, "eveapi_cache_revalidations_total %d\n", m.revalidations)
+	fmt.Fprintf(w, "# HELP eveapi_cache_memory_hits_total ESI cache hits served from memory\n# TYPE eveapi_cache_memory_hits_total counter\n")
+	fmt.Fprintf(w, "eveapi_cache_memory_hits_total %d\n", m.memoryHits)
+
+	fmt.Fprintf(w, "# HELP eveapi_esi_request_duration_seconds Time taken by ESI requests\n# TYPE eveapi_esi_request_duration_seconds histogram\n")
+	var n uint64
+	for i, b := range latencyBuckets {
+		n += m.buckets[i]
+		fmt.Fprintf(w, "eveapi_esi_request_duration_seconds_bucket{le=\"%g\"} %d\n", b, n)
+	}
+	fmt.Fprintf(w, "eveapi_esi_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.count)
+	fmt.Fprintf(w, "eveapi_esi_request_duration_seconds_sum %g\n", m.sum)
+	fmt.Fprintf(w, "eveapi_esi_request_duration_seconds_count %d\n", m.count)
+
+	statuses := make([]string, 0, len(m.errors))
+	for s := range m.errors {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+
+	fmt.Fprintf(w, "# HELP eveapi_esi_errors_total Failed ESI requests, by status. \"none\" means no response\n# TYPE eveapi_esi_errors_total counter\n")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "eveapi_esi_errors_total{status=%q} %d\n", s, m.errors[s])
+	}
+}
+
+// timedTransport records metrics for requests to ESI
+type timedTransport struct {
+	next    http.RoundTripper
+	metrics *metrics
+}
+
+func (t *timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme+"://"+req.URL.Host != apiURL {
+		return t.next.RoundTrip(req)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+	}
+	t.metrics.upstream(time.Since(start), status)
+	return resp, err
+}
+
+// clientContext gives a context that makes oauth2 send requests
+// through a timedTransport
+func (e *Eve) clientContext() context.Context {
+	client := &http.Client{
+		Transport: &timedTransport{next: http.DefaultTransport, metrics: e.metrics},
+	}
+	return context.WithValue(context.Background(), oauth2.HTTPClient, client)
+}
+
+// WriteMetrics writes cache and ESI metrics in the Prometheus text format
+func (e *Eve) WriteMetrics(w io.Writer) {
+	e.metrics.write(w)
+}
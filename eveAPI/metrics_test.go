@@ -0,0 +1,57 @@
+package eveapi
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type fakeTransport func(*http.Request) (*http.Response, error)
+
+func (f fakeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics()
+	m.cacheResult(cacheHit)
+	m.cacheResult(cacheHit)
+	m.cacheResult(cacheStale)
+
+	tt := &timedTransport{
+		metrics: m,
+		next: fakeTransport(func(r *http.Request) (*http.Response, error) {
+			switch r.URL.Path {
+			case "/missing":
+				return &http.Response{StatusCode: http.StatusNotFound}, nil
+			case "/broken":
+				return nil, errors.New("connection refused")
+			}
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+	}
+	for _, u := range []string{apiURL + "/ok", apiURL + "/missing", apiURL + "/broken", "https://login.eveonline.com/missing"} {
+		req, _ := http.NewRequest("GET", u, nil)
+		tt.RoundTrip(req)
+	}
+
+	var buf bytes.Buffer
+	m.write(&buf)
+	body := buf.String()
+
+	expected := []string{
+		`eveapi_cache_requests_total{result="hit"} 2`,
+		`eveapi_cache_requests_total{result="miss"} 0`,
+		`eveapi_cache_requests_total{result="stale"} 1`,
+		`eveapi_esi_request_duration_seconds_count 3`,
+		`eveapi_esi_errors_total{status="404"} 1`,
+		`eveapi_esi_errors_total{status="none"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e+"\n") {
+			t.Errorf("Missing %q in:\n%s", e, body)
+		}
+	}
+}
@@ -3,17 +3,22 @@ package eveapi
 import (
 	"encoding/json"
 	"errors"
-	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
+// openData opens a file from the static data export
+func (e *Eve) openData(name string) (*os.File, error) {
+	return os.Open(filepath.Join(e.paths.Data, filepath.FromSlash(name)))
+}
+
 func (e *Eve) loadTypes() error {
 	e.types = make(map[int32]*EveType)
 
-	f, err := os.Open("../wwwroot/eve/data/fsd/typeIDs.json")
+	f, err := e.openData("fsd/typeIDs.json")
 	if err != nil {
 		return err
 	}
@@ -54,7 +59,7 @@ func (e *Eve) loadTypes() error {
 func (e *Eve) loadBlueprints() error {
 	e.blueprints = eveBlueprints{}
 
-	f, err := os.Open("../wwwroot/eve/data/fsd/blueprints.json")
+	f, err := e.openData("fsd/blueprints.json")
 	if err != nil {
 		return err
 	}
@@ -89,7 +94,7 @@ func (e *Eve) loadBlueprints() error {
 func (e *Eve) loadAttributes() error {
 	e.attributes = make(map[int32]*EveAttribute)
 
-	f, err := os.Open("../wwwroot/eve/data/bsd/dgmAttributeTypes.json")
+	f, err := e.openData("bsd/dgmAttributeTypes.json")
 	if err != nil {
 		return err
 	}
@@ -119,7 +124,7 @@ func (e *Eve) loadAttributes() error {
 	return nil
 }
 
-func setTypeAttributes(types eveTypes, attr eveAttributes) error {
+func (e *Eve) setTypeAttributes(types eveTypes, attr eveAttributes) error {
 
 	type Tuple struct {
 		AttrID     int32    `json:"attributeID"`
@@ -128,7 +133,7 @@ func setTypeAttributes(types eveTypes, attr eveAttributes) error {
 		ValueFloat *float64 `json:"valueFloat"`
 	}
 
-	f, err := os.Open("../wwwroot/eve/data/bsd/dgmTypeAttributes.json")
+	f, err := e.openData("bsd/dgmTypeAttributes.json")
 	if err != nil {
 		return err
 	}
@@ -180,7 +185,7 @@ func setTypeAttributes(types eveTypes, attr eveAttributes) error {
 }
 
 func (e *Eve) loadGroups() error {
-	f, err := os.Open("../wwwroot/eve/data/fsd/groupIds.json")
+	f, err := e.openData("fsd/groupIds.json")
 	if err != nil {
 		return err
 	}
@@ -200,7 +205,7 @@ func (e *Eve) loadTypeMaterials() error {
 		Quantity       int64 `json:"quantity"`
 	}
 
-	f, err := os.Open("../wwwroot/eve/data/bsd/invTypeMaterials.json")
+	f, err := e.openData("bsd/invTypeMaterials.json")
 	if err != nil {
 		return err
 	}
@@ -240,22 +245,22 @@ func (e *Eve) loadTypeMaterials() error {
 }
 
 func (e *Eve) loadStatic() error {
-	log.Println("Loading types")
+	logger.Info("Loading types")
 	if err := e.loadTypes(); err != nil {
 		return err
 	}
 
-	log.Println("Loading materials")
+	logger.Info("Loading materials")
 	if err := e.loadTypeMaterials(); err != nil {
 		return err
 	}
 
-	log.Println("Loading blueprints")
+	logger.Info("Loading blueprints")
 	if err := e.loadBlueprints(); err != nil {
 		return err
 	}
 
-	log.Println("Loading Groups")
+	logger.Info("Loading groups")
 	if err := e.loadGroups(); err != nil {
 		return err
 	}
@@ -2,12 +2,27 @@ package eveapi
 
 import (
 	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 )
 
+// testEve gives an Eve that reads the static data export. It isn't in
+// git, it has to be downloaded into wwwroot/eve/data to run these, so
+// they're skipped without it
+func testEve(t *testing.T) *Eve {
+	_, file, _, _ := runtime.Caller(0)
+	data := filepath.Join(filepath.Dir(file), "..", "wwwroot", "eve", "data")
+	if _, err := os.Stat(data); os.IsNotExist(err) {
+		t.Skipf("No static data export in %s", data)
+	}
+	return &Eve{paths: Paths{Data: data}}
+}
+
 func TestGetTypes(t *testing.T) {
 
-	eve := &Eve{}
+	eve := testEve(t)
 	err := eve.loadTypes()
 
 	if err != nil {
@@ -23,7 +38,7 @@ func TestGetTypes(t *testing.T) {
 }
 
 func TestGetAttributes(t *testing.T) {
-	eve := &Eve{}
+	eve := testEve(t)
 	err := eve.loadAttributes()
 
 	if err != nil {
@@ -39,7 +54,7 @@ func TestGetAttributes(t *testing.T) {
 }
 
 func TestSetMaterials(t *testing.T) {
-	eve := &Eve{}
+	eve := testEve(t)
 
 	err := eve.loadTypes()
 	if err != nil {
@@ -61,7 +76,7 @@ func TestSetMaterials(t *testing.T) {
 }
 
 func TestReadBlueprints(t *testing.T) {
-	eve := &Eve{}
+	eve := testEve(t)
 
 	if err := eve.loadTypes(); err != nil {
 		t.Fatal(err)
@@ -2,8 +2,8 @@ package eveapi
 
 import (
 	"encoding/json"
-	"log"
 	"os"
+	"sync"
 
 	"golang.org/x/oauth2"
 )
@@ -20,6 +20,12 @@ type User struct {
 type UserCache struct {
 	Users map[string]*User
 	path  string
+
+	mu sync.RWMutex
+	// writes are saved one at a time, so they don't mix in the file
+	writeMu sync.Mutex
+	// writes started by add and remove that haven't finished
+	pending sync.WaitGroup
 }
 
 func readUserCache(path string) (*UserCache, error) {
@@ -31,38 +37,94 @@ func readUserCache(path string) (*UserCache, error) {
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Thats fine, return an empty cache
-			log.Print("INFO: Cache not found on disk, creating")
+			logger.Info("User cache not found on disk, creating", "path", path)
 			u.Users = make(map[string]*User)
 			return u, nil
 		}
 		return nil, err
 	}
 
+	defer in.Close()
+
 	if err = json.NewDecoder(in).Decode(u); err != nil {
 		return nil, err
 	}
+	if u.Users == nil {
+		u.Users = make(map[string]*User)
+	}
 
 	return u, nil
 }
 
+// readable checks that the cache file can still be read. A missing
+// file is fine, it gets created on the next write
+func (u *UserCache) readable() error {
+	in, err := os.Open(u.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return in.Close()
+}
+
 func (u *UserCache) write() {
+	// Copy the users once it's our turn, so a write that started
+	// earlier can't finish later with older users
+	u.writeMu.Lock()
+	defer u.writeMu.Unlock()
+
+	u.mu.RLock()
+	users := make(map[string]*User, len(u.Users))
+	for id, user := range u.Users {
+		users[id] = user
+	}
+	u.mu.RUnlock()
 
 	out, err := os.Create(u.path)
 	if err != nil {
-		log.Print("WARN: Can't save user cache: ", err)
+		logger.Warn("Can't save user cache", "err", err)
+		return
 	}
+	defer out.Close()
 
-	if err = json.NewEncoder(out).Encode(u); err != nil {
-		log.Print("WARN: Can't save user cache: ", err)
+	if err = json.NewEncoder(out).Encode(struct{ Users map[string]*User }{users}); err != nil {
+		logger.Warn("Can't save user cache", "err", err)
 	}
 }
 
+// save writes the cache in the background
+func (u *UserCache) save() {
+	u.pending.Add(1)
+	go func() {
+		defer u.pending.Done()
+		u.write()
+	}()
+}
+
+// flush waits for background writes to finish
+func (u *UserCache) flush() {
+	u.pending.Wait()
+}
+
 func (u *UserCache) user(id string) (*User, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
 	user, ok := u.Users[id]
 	return user, ok
 }
 
 func (u *UserCache) add(id string, user *User) {
+	u.mu.Lock()
 	u.Users[id] = user
-	go u.write()
+	u.mu.Unlock()
+	u.save()
+}
+
+func (u *UserCache) remove(id string) {
+	u.mu.Lock()
+	delete(u.Users, id)
+	u.mu.Unlock()
+	u.save()
 }
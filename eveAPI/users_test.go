@@ -0,0 +1,43 @@
+package eveapi
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestUserCacheConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	u, err := readUserCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			state := strconv.Itoa(i)
+			u.add(state, &User{ID: int32(i)})
+			u.user(state)
+			if i%2 == 0 {
+				u.remove(state)
+			}
+		}(i)
+	}
+	wg.Wait()
+	u.flush()
+
+	saved, err := readUserCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Users) != 10 {
+		t.Errorf("Expected 10 users saved, got %d", len(saved.Users))
+	}
+	if user, ok := saved.user("3"); !ok || user.ID != 3 {
+		t.Errorf("Expected user 3, got %+v", user)
+	}
+}
@@ -3,8 +3,11 @@ package linkshare
 // Adapted from https://github.com/gorilla/websocket/blob/master/examples/chat
 
 import (
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,6 +20,14 @@ const (
 	maxMessageSize = 4096
 )
 
+// logger is used for everything the package logs
+var logger = slog.Default()
+
+// SetLogger sets the logger used by the linkshare package
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -56,10 +67,11 @@ func (c *client) read() {
 		err := c.conn.ReadJSON(&msg)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("Websocket client error: %v", err)
+				logger.Warn("Websocket client error", "err", err)
 			}
 			break
 		}
+		atomic.AddUint64(&c.hub.received, 1)
 		c.hub.in <- clientMessage{c, msg}
 	}
 }
@@ -80,7 +92,9 @@ func (c *client) write() {
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
-			c.conn.WriteJSON(msg)
+			if c.conn.WriteJSON(msg) == nil {
+				atomic.AddUint64(&c.hub.sent, 1)
+			}
 
 			// Write any queued messages as well
 			n := len(c.out)
@@ -89,6 +103,7 @@ func (c *client) write() {
 				if err != nil {
 					return
 				}
+				atomic.AddUint64(&c.hub.sent, 1)
 			}
 		case <-ticker.C:
 			c.setWriteDeadline()
@@ -107,6 +122,11 @@ type clientMessage struct {
 
 // Hub manages clients and broadcasts messages
 type Hub struct {
+	// Updated atomically, for metrics. Kept first for alignment
+	received  uint64
+	sent      uint64
+	connected int64
+
 	clients    map[*client]bool
 	handlers   map[MessageHandler]bool
 	in         chan clientMessage
@@ -159,7 +179,7 @@ func (h *Hub) Shutdown() {
 func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("Upgrading websocket failed: %v", err)
+		logger.Warn("Upgrading websocket failed", "err", err)
 		return
 	}
 
@@ -180,6 +200,18 @@ func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (h *Hub) closeclient(c *client) {
 	close(c.out)
 	delete(h.clients, c)
+	atomic.StoreInt64(&h.connected, int64(len(h.clients)))
+}
+
+// WriteMetrics writes the number of connected clients and message
+// counts in the Prometheus text format
+func (h *Hub) WriteMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP linkshare_clients Connected websocket clients\n# TYPE linkshare_clients gauge\n")
+	fmt.Fprintf(w, "linkshare_clients %d\n", atomic.LoadInt64(&h.connected))
+	fmt.Fprintf(w, "# HELP linkshare_messages_received_total Messages received from clients\n# TYPE linkshare_messages_received_total counter\n")
+	fmt.Fprintf(w, "linkshare_messages_received_total %d\n", atomic.LoadUint64(&h.received))
+	fmt.Fprintf(w, "# HELP linkshare_messages_sent_total Messages sent to clients\n# TYPE linkshare_messages_sent_total counter\n")
+	fmt.Fprintf(w, "linkshare_messages_sent_total %d\n", atomic.LoadUint64(&h.sent))
 }
 
 // Main loop. Wait for messages from clients,
@@ -190,6 +222,7 @@ func (h *Hub) run() {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
+			atomic.StoreInt64(&h.connected, int64(len(h.clients)))
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				h.closeclient(client)
@@ -201,7 +234,7 @@ func (h *Hub) run() {
 				})
 			}
 		case <-h.shutdown:
-			log.Printf("Closing %d websockets", len(h.clients))
+			logger.Info("Closing websockets", "count", len(h.clients))
 			for client := range h.clients {
 				h.closeclient(client)
 			}
@@ -1,9 +1,11 @@
 module github.com/moosemorals/mm/main
 
 require (
+	github.com/moosemorals/mm/articles v0.0.0
 	github.com/moosemorals/mm/eveapi v0.0.0
 	github.com/moosemorals/mm/linkshare v0.0.0
 	github.com/moosemorals/mm/server v0.0.0
+	github.com/moosemorals/mm/wwwroot v0.0.0
 )
 
 replace github.com/moosemorals/mm/server => ../server
@@ -11,3 +13,7 @@ replace github.com/moosemorals/mm/server => ../server
 replace github.com/moosemorals/mm/linkshare => ../linkshare
 
 replace github.com/moosemorals/mm/eveapi => ../eveapi
+
+replace github.com/moosemorals/mm/wwwroot => ../wwwroot
+
+replace github.com/moosemorals/mm/articles => ../articles
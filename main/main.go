@@ -3,50 +3,193 @@ package main
 
 import (
 	"flag"
+	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/moosemorals/mm/articles"
 	"github.com/moosemorals/mm/eveapi"
-	_ "github.com/moosemorals/mm/linkshare"
+	"github.com/moosemorals/mm/linkshare"
 	"github.com/moosemorals/mm/server"
+	"github.com/moosemorals/mm/wwwroot"
 )
 
 func main() {
 	opts := server.Options{}
 
-
-	wwwroot := flag.String("wwwroot", ".", "Directory to serve static files from")
+	config := flag.String("config", "", "JSON file to read server options from")
+	override := flag.String("wwwroot", "", "Directory of static files that override the built in ones")
+	evedir := flag.String("evedir", "", "Directory with the eveapi config.json, users and cache (default the directory the binary is in)")
+	evedata := flag.String("evedata", "", "Directory with the EVE static data export (default eve/data in -wwwroot, or data in -evedir)")
 	debug := flag.Bool("debug", false, "Use debug certificates")
+	siteURL := flag.String("siteurl", "", "Canonical URL of the site, like https://example.com, for links in feeds and the sitemap (default the URL each request was sent to)")
 	flag.Parse()
 
+	if *config != "" {
+		var err error
+		opts, err = server.LoadOptions(*config)
+		if err != nil {
+			log.Fatal("Can't read config: ", err)
+		}
+	}
+
+	// Anything still using the log package goes through slog as well
+	slog.SetDefault(opts.Logger("main"))
+	server.SetLogger(opts.Logger("server"))
+	eveapi.SetLogger(opts.Logger("eveapi"))
+	linkshare.SetLogger(opts.Logger("linkshare"))
+	articles.SetLogger(opts.Logger("articles"))
+
 	if *debug {
-		log.Println("Debug enabled")
+		slog.Info("Debug enabled")
 		opts.SetDebug()
 	}
 
 	for _, a := range flag.Args() {
 		parts := strings.Split(a, ",")
-		if len(parts) == 2 {
-			opts.AddAddr(parts[0], parts[1])
+		if len(parts) != 2 {
+			log.Fatalf("Bad address pair %q, expected http,https", a)
+		}
+		if err := opts.AddAddr(parts[0], parts[1]); err != nil {
+			log.Fatalf("Bad address pair %q: %v", a, err)
 		}
 	}
 
 	// Make the server
-	s := server.Create(opts)
+	s, err := server.Create(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Add a static handler
-	s.Handle("/", http.FileServer(http.Dir(*wwwroot)))
+	var files fs.FS = wwwroot.Files
+	if *override != "" {
+		files = server.Overlay(os.DirFS(*override), wwwroot.Files)
+	}
 
-	// Add the eve handler
-	s.Handle("/eveapi/", eveapi.NewEve())
+	// Handlers are made the first time they're needed, so the same
+	// one can be mounted on more than one host. Handlers that need to
+	// know where they're mounted use the first path they're given
+	handlers := make(map[string]http.Handler)
+	var handler func(name, path string) http.Handler
+	handler = func(name, path string) http.Handler {
+		if h, ok := handlers[name]; ok {
+			return h
+		}
+		var h http.Handler
+		switch name {
+		case "static":
+			static := server.NewStatic(files)
+			if err := static.Fingerprint(); err != nil {
+				log.Fatal("Can't fingerprint static files: ", err)
+			}
+			s.SetErrorPage(static.ErrorPage())
+			h = static
+		case "eveapi":
+			paths, err := evePaths(*evedir, *evedata, *override)
+			if err != nil {
+				log.Fatal("Can't find eveapi files: ", err)
+			}
+			eve := eveapi.NewEve(paths)
+			s.AddLogFields(eve.LogFields)
+			s.AddMetrics(eve.WriteMetrics)
+			s.AddReadyCheck("eveapi", eve.Ready)
+			s.AddShutdownHook("eveapi", eve.Shutdown)
+			s.SetUserKey(eve.UserKey)
+			h = eve
+		case "articles":
+			static := handler("static", "/").(*server.Static)
+			site, err := articles.New(files, articles.Config{
+				Dir:       "articles",
+				Prefix:    path,
+				Title:     "Articles",
+				Fallback:  static,
+				AssetPath: static.AssetPath,
+				Reload:    *debug,
+				Drafts:    *debug,
+				BaseURL:   *siteURL,
+			})
+			if err != nil {
+				log.Fatal("Can't load articles: ", err)
+			}
+			if *debug && *override == "" {
+				slog.Warn("Articles are built in, so -debug can't pick up changes to them without -wwwroot")
+			}
+			h = site
+		case "linkshare":
+			hub := linkshare.NewHub()
+			s.OnShutdown(hub.Shutdown)
+			s.AddMetrics(hub.WriteMetrics)
+			h = hub
+		case "metrics":
+			h = s.MetricsHandler()
+		default:
+			log.Fatalf("%s: Unknown handler %q", *config, name)
+		}
+		handlers[name] = h
+		return h
+	}
 
-	/*
-	// Add the linkshare handler
-	hub := linkshare.NewHub()
-	s.Handle("/ws", hub)
-	s.OnShutdown(hub.Shutdown)
-*/
+	// mount puts a handler on the site, or on a virtual host. Articles
+	// bring their sitemap with them
+	mount := func(host, name, path string) {
+		handle := s.Handle
+		if host != "" {
+			handle = func(path string, h http.Handler, mw ...server.Middleware) {
+				s.HandleHost(host, path, h, mw...)
+			}
+		}
+		h := handler(name, path)
+		handle(path, h)
+		if site, ok := h.(*articles.Site); ok {
+			handle("/sitemap.xml", site.Sitemap())
+		}
+	}
 
-	s.Start()
+	for name, path := range opts.Mounts() {
+		mount("", name, path)
+	}
+	for _, v := range opts.VirtualHosts() {
+		for name, path := range v.Mounts {
+			mount(v.Host, name, path)
+		}
+	}
+
+	if err := s.Start(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// evePaths works out where eveapi keeps its files. Nothing depends on
+// the working directory unless it's given as a relative path. The
+// static data export stays where it has always been, in wwwroot/eve/data,
+// when there's a -wwwroot directory to find it in
+func evePaths(dir, data, override string) (eveapi.Paths, error) {
+	if dir == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return eveapi.Paths{}, err
+		}
+		dir = filepath.Dir(exe)
+	}
+	paths := eveapi.DefaultPaths(dir)
+	switch {
+	case data != "":
+		paths.Data = data
+	case override != "":
+		paths.Data = filepath.Join(override, "eve", "data")
+	}
+
+	for _, p := range []*string{&paths.Config, &paths.Data, &paths.Users, &paths.Cache} {
+		abs, err := filepath.Abs(*p)
+		if err != nil {
+			return eveapi.Paths{}, err
+		}
+		*p = abs
+	}
+	slog.Info("Using eveapi files", "config", paths.Config, "data", paths.Data, "users", paths.Users, "cache", paths.Cache)
+	return paths, nil
 }
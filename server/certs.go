@@ -0,0 +1,189 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newCertManager builds an autocert.Manager from the ACME options
+func newCertManager(o *Options) *autocert.Manager {
+	m := &autocert.Manager{
+		Cache:      autocert.DirCache(o.getCertCache()),
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: o.getHostPolicy(),
+		Email:      o.acmeEmail,
+	}
+
+	if o.acmeDirectory != "" {
+		client := &acme.Client{DirectoryURL: o.acmeDirectory}
+		if o.acmeRoots != nil {
+			client.HTTPClient = &http.Client{
+				Transport: &http.Transport{
+					Proxy:           http.ProxyFromEnvironment,
+					TLSClientConfig: &tls.Config{RootCAs: o.acmeRoots},
+				},
+			}
+		}
+		m.Client = client
+	}
+	return m
+}
+
+// How often certificate files are checked for changes
+const certPollInterval = 10 * time.Second
+
+// CertFile is a certificate chain and private key on disk, both PEM encoded
+type CertFile struct {
+	Cert string
+	Key  string
+}
+
+var debugCertFiles = []CertFile{{Cert: "cert.pem", Key: "key.pem"}}
+
+// certStore serves certificates loaded from disk, picking between
+// them by SNI. The files are reloaded when they change, or on SIGHUP.
+type certStore struct {
+	files []CertFile
+	log   *slog.Logger
+
+	mu      sync.RWMutex
+	certs   []*tls.Certificate
+	byName  map[string]*tls.Certificate
+	modTime time.Time
+}
+
+// newCertStore loads the certificates, and fails if it can't, since
+// https can't work without them
+func newCertStore(files []CertFile, log *slog.Logger) (*certStore, error) {
+	c := &certStore{files: files, log: log}
+	if err := c.load(); err != nil {
+		return nil, fmt.Errorf("Can't load certificates: %v", err)
+	}
+	return c, nil
+}
+
+// load reads all the certificate files. If any of them fail, the
+// currently loaded certificates are kept, and the files aren't tried
+// again until they change
+func (c *certStore) load() error {
+	// Taken first, so changes made while loading are seen next time
+	modTime := c.latestModTime()
+	c.mu.Lock()
+	c.modTime = modTime
+	c.mu.Unlock()
+
+	var certs []*tls.Certificate
+	byName := make(map[string]*tls.Certificate)
+
+	for _, f := range c.files {
+		cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+		if err != nil {
+			return err
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.Cert, err)
+		}
+		cert.Leaf = leaf
+
+		certs = append(certs, &cert)
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, n := range names {
+			n = strings.ToLower(n)
+			if _, ok := byName[n]; !ok {
+				byName[n] = &cert
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.certs = certs
+	c.byName = byName
+	c.mu.Unlock()
+
+	c.log.Info("Loaded certificates", "count", len(certs))
+	return nil
+}
+
+// latestModTime finds the most recent modification time of the files
+func (c *certStore) latestModTime() time.Time {
+	var latest time.Time
+	for _, f := range c.files {
+		for _, p := range []string{f.Cert, f.Key} {
+			if fi, err := os.Stat(p); err == nil && fi.ModTime().After(latest) {
+				latest = fi.ModTime()
+			}
+		}
+	}
+	return latest
+}
+
+// GetCertificate is used as tls.Config.GetCertificate
+func (c *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.certs) == 0 {
+		return nil, errors.New("No certificates loaded")
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := c.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := c.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+
+	// No match (or no SNI), use the first one
+	return c.certs[0], nil
+}
+
+// watch reloads certificates on SIGHUP, or when the files change,
+// until stop is closed
+func (c *certStore) watch(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			c.log.Info("Got SIGHUP, reloading certificates")
+		case <-ticker.C:
+			c.mu.RLock()
+			changed := c.latestModTime().After(c.modTime)
+			c.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			c.log.Info("Certificate files changed, reloading")
+		}
+		if err := c.load(); err != nil {
+			c.log.Error("Can't reload certificates, keeping the old ones", "err", err)
+		}
+	}
+}
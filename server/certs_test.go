@@ -0,0 +1,125 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self signed certificate for names into dir
+func writeCert(t *testing.T, dir, base string, serial int64, names ...string) CertFile {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := CertFile{
+		Cert: filepath.Join(dir, base+".pem"),
+		Key:  filepath.Join(dir, base+".key"),
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(f.Cert, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f.Key, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func serialFor(t *testing.T, c *certStore, name string) int64 {
+	cert, err := c.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func TestCertStore(t *testing.T) {
+	dir := t.TempDir()
+
+	a := writeCert(t, dir, "a", 1, "a.example.com")
+	b := writeCert(t, dir, "b", 2, "*.b.example.com", "b.example.com")
+
+	c, err := newCertStore([]CertFile{a, b}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		serial int64
+	}{
+		{"a.example.com", 1},
+		{"A.Example.com.", 1},
+		{"b.example.com", 2},
+		{"www.b.example.com", 2},
+		{"unknown.example.com", 1},
+		{"", 1},
+	}
+	for _, tc := range tests {
+		if got := serialFor(t, c, tc.name); got != tc.serial {
+			t.Errorf("%q: expected serial %d, got %d", tc.name, tc.serial, got)
+		}
+	}
+
+	// Replace a, and check that the new one is served after a reload
+	writeCert(t, dir, "a", 3, "a.example.com")
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := serialFor(t, c, "a.example.com"); got != 3 {
+		t.Errorf("Expected reloaded serial 3, got %d", got)
+	}
+
+	// A broken file keeps the old certificates
+	if err := ioutil.WriteFile(b.Key, []byte("nonsense"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.load(); err == nil {
+		t.Error("Expected an error loading a broken key")
+	}
+	if got := serialFor(t, c, "b.example.com"); got != 2 {
+		t.Errorf("Expected old serial 2, got %d", got)
+	}
+	// and isn't tried again until it changes
+	if changed := c.latestModTime().After(c.modTime); changed {
+		t.Error("A failed reload should record the files' modification time")
+	}
+}
+
+func TestCertStoreEmpty(t *testing.T) {
+	if _, err := newCertStore([]CertFile{{Cert: "missing.pem", Key: "missing.key"}}, logger); err == nil {
+		t.Error("Expected an error with missing certificates")
+	}
+	c := &certStore{}
+	if _, err := c.GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Error("Expected an error with no certificates")
+	}
+}
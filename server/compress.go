@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content types worth compressing. Anything starting text/ is
+// compressed as well
+var compressibleTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"application/atom+xml":   true,
+	"application/rss+xml":    true,
+	"application/wasm":       true,
+	"image/svg+xml":          true,
+	"image/x-icon":           true,
+}
+
+var gzipPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+var brotliPool = sync.Pool{
+	New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotli.DefaultCompression)
+	},
+}
+
+// Compress compresses responses with brotli or gzip, if the client
+// accepts them and the content type is worth compressing
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		enc := chooseEncoding(r.Header.Get("Accept-Encoding"))
+		if enc == "" || r.Method == "HEAD" || isUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: enc}
+		next.ServeHTTP(cw, r)
+		// Not deferred, so that a panic doesn't send the headers
+		// before Recover gets a chance to send an error page
+		cw.Close()
+	})
+}
+
+// chooseEncoding picks the best encoding from an Accept-Encoding header
+func chooseEncoding(accept string) string {
+	br, gz := acceptedEncodings(accept)
+	if br {
+		return "br"
+	}
+	if gz {
+		return "gzip"
+	}
+	return ""
+}
+
+// acceptedEncodings checks if an Accept-Encoding header allows brotli and gzip
+func acceptedEncodings(accept string) (br, gz bool) {
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		ok := true
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				q, err := strconv.ParseFloat(f[2:], 64)
+				ok = err == nil && q > 0
+			}
+		}
+		switch name {
+		case "br":
+			br = ok
+		case "gzip":
+			gz = ok
+		}
+	}
+	return br, gz
+}
+
+func isUpgrade(r *http.Request) bool {
+	for _, v := range r.Header["Connection"] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func compressible(contentType string) bool {
+	t := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return strings.HasPrefix(t, "text/") || compressibleTypes[t]
+}
+
+// compressWriter holds back the status until the first write, so it
+// can decide if the response should be compressed
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	status  int
+	started bool
+	out     io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.started || w.status != 0 {
+		return
+	}
+	if status < 200 {
+		// Informational responses go straight through
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+}
+
+// start decides whether to compress, and sends the headers.
+// body is the start of the response, used to sniff the content type
+func (w *compressWriter) start(body []byte) {
+	w.started = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(body) > 0 {
+		h.Set("Content-Type", http.DetectContentType(body))
+	}
+
+	if w.status != http.StatusNoContent && w.status != http.StatusNotModified &&
+		w.status != http.StatusPartialContent && h.Get("Content-Encoding") == "" &&
+		h.Get("Content-Range") == "" && compressible(h.Get("Content-Type")) {
+
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			// The compressed body isn't byte for byte the same
+			h.Set("ETag", "W/"+etag)
+		}
+
+		switch w.encoding {
+		case "br":
+			bw := brotliPool.Get().(*brotli.Writer)
+			bw.Reset(w.ResponseWriter)
+			w.out = bw
+		case "gzip":
+			gw := gzipPool.Get().(*gzip.Writer)
+			gw.Reset(w.ResponseWriter)
+			w.out = gw
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		w.start(b)
+	}
+	if w.out != nil {
+		return w.out.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) Flush() {
+	if !w.started {
+		w.start(nil)
+	}
+	switch out := w.out.(type) {
+	case *gzip.Writer:
+		out.Flush()
+	case *brotli.Writer:
+		out.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijack not supported")
+	}
+	// Nothing more goes through this writer
+	w.started = true
+	return h.Hijack()
+}
+
+// Close finishes the compressed stream
+func (w *compressWriter) Close() error {
+	if !w.started {
+		w.start(nil)
+	}
+	if w.out == nil {
+		return nil
+	}
+
+	err := w.out.Close()
+	switch out := w.out.(type) {
+	case *gzip.Writer:
+		gzipPool.Put(out)
+	case *brotli.Writer:
+		brotliPool.Put(out)
+	}
+	w.out = nil
+	return err
+}
@@ -0,0 +1,651 @@
+package server
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigError reports a problem with a key in a config file
+type ConfigError struct {
+	File string
+	Key  string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("%s: %v", e.File, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", e.File, e.Key, e.Err)
+}
+
+// config mirrors the layout of the JSON config file
+type config struct {
+	Debug            bool              `json:"debug"`
+	Listeners        []listenerConfig  `json:"listeners"`
+	Hosts            []string          `json:"hosts"`
+	TLS              tlsConfig         `json:"tls"`
+	ACME             acmeConfig        `json:"acme"`
+	RedirectStatus   int               `json:"redirectStatus"`
+	HSTS             hstsConfig        `json:"hsts"`
+	Middleware       middlewareConfig  `json:"middleware"`
+	Logging          loggingConfig     `json:"logging"`
+	Timeouts         timeoutConfig     `json:"timeouts"`
+	RedirectTimeouts timeoutConfig     `json:"redirectTimeouts"`
+	Shutdown         shutdownConfig    `json:"shutdown"`
+	Handlers         map[string]string `json:"handlers"`
+	VirtualHosts     []vhostConfig     `json:"virtualHosts"`
+	Proxies          []proxyConfig     `json:"proxies"`
+	TrustedProxies   []string          `json:"trustedProxies"`
+	RateLimits       []rateLimitConfig `json:"rateLimits"`
+	PublicStatus     bool              `json:"publicStatus"`
+}
+
+// A listener is either an http/https pair, where http redirects
+// to https, a plain http listener that serves the site, or an admin
+// listener that serves metrics
+type listenerConfig struct {
+	HTTP  string `json:"http"`
+	HTTPS string `json:"https"`
+	Plain string `json:"plain"`
+	Admin string `json:"admin"`
+	// ProxyProtocol and MaxConns apply to every address in the listener
+	ProxyProtocol bool `json:"proxyProtocol"`
+	MaxConns      int  `json:"maxConns"`
+}
+
+type tlsConfig struct {
+	Mode  string           `json:"mode"`
+	Certs []certFileConfig `json:"certs"`
+}
+
+type certFileConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+type acmeConfig struct {
+	CacheDir  string `json:"cacheDir"`
+	Email     string `json:"email"`
+	Directory string `json:"directory"`
+	CACert    string `json:"caCert"`
+}
+
+type hstsConfig struct {
+	MaxAge            string `json:"maxAge"`
+	IncludeSubdomains bool   `json:"includeSubdomains"`
+	Preload           bool   `json:"preload"`
+}
+
+type middlewareConfig struct {
+	RequestID bool           `json:"requestID"`
+	Recover   bool           `json:"recover"`
+	Compress  bool           `json:"compress"`
+	Security  securityConfig `json:"security"`
+}
+
+type securityConfig struct {
+	ContentSecurityPolicy string `json:"contentSecurityPolicy"`
+	ReferrerPolicy        string `json:"referrerPolicy"`
+	NoSniff               bool   `json:"noSniff"`
+}
+
+type loggingConfig struct {
+	Format string            `json:"format"`
+	Level  string            `json:"level"`
+	Levels map[string]string `json:"levels"`
+}
+
+// Durations are strings like "15s", parsed with time.ParseDuration
+type timeoutConfig struct {
+	Read  string `json:"read"`
+	Write string `json:"write"`
+	Idle  string `json:"idle"`
+}
+
+type vhostConfig struct {
+	Host       string            `json:"host"`
+	Handlers   map[string]string `json:"handlers"`
+	RedirectTo string            `json:"redirectTo"`
+}
+
+type proxyConfig struct {
+	Path           string   `json:"path"`
+	Host           string   `json:"host"`
+	Upstreams      []string `json:"upstreams"`
+	StripPrefix    bool     `json:"stripPrefix"`
+	Balance        string   `json:"balance"`
+	HealthCheck    string   `json:"healthCheck"`
+	HealthInterval string   `json:"healthInterval"`
+}
+
+// Rates are strings like "10/s", parsed with parseRate
+type rateLimitConfig struct {
+	Path  string `json:"path"`
+	Rate  string `json:"rate"`
+	Burst int    `json:"burst"`
+	By    string `json:"by"`
+}
+
+type shutdownConfig struct {
+	Delay string `json:"delay"`
+	Drain string `json:"drain"`
+	Hook  string `json:"hook"`
+}
+
+// LoadOptions reads server options from a JSON config file
+func LoadOptions(path string) (Options, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Options{}, err
+	}
+	return parseOptions(path, raw)
+}
+
+func parseOptions(path string, raw []byte) (Options, error) {
+	var opts Options
+	var c config
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return opts, decodeError(path, raw, dec.InputOffset(), err)
+	}
+
+	fail := func(key string, err error) (Options, error) {
+		return Options{}, &ConfigError{File: path, Key: key, Err: err}
+	}
+
+	if c.Debug {
+		opts.SetDebug()
+	}
+
+	for i, l := range c.Listeners {
+		key := fmt.Sprintf("listeners[%d]", i)
+		if l.Admin != "" {
+			if l.HTTP != "" || l.HTTPS != "" || l.Plain != "" {
+				return fail(key, errors.New("admin can't be combined with other addresses"))
+			}
+			if err := opts.AddAdmin(l.Admin); err != nil {
+				return fail(key+".admin", err)
+			}
+			continue
+		}
+		if l.Plain != "" {
+			if l.HTTP != "" || l.HTTPS != "" {
+				return fail(key, errors.New("plain can't be combined with http or https"))
+			}
+			if err := opts.AddHTTP(l.Plain); err != nil {
+				return fail(key+".plain", err)
+			}
+			continue
+		}
+		if l.HTTP == "" && l.HTTPS == "" {
+			return fail(key, errors.New("Need one of http, https, plain or admin"))
+		}
+		if l.HTTP != "" {
+			if err := checkAddr(l.HTTP); err != nil {
+				return fail(key+".http", err)
+			}
+		}
+		if l.HTTPS != "" {
+			if err := checkAddr(l.HTTPS); err != nil {
+				return fail(key+".https", err)
+			}
+		}
+		if err := opts.AddAddr(l.HTTP, l.HTTPS); err != nil {
+			return fail(key, err)
+		}
+	}
+
+	for i, l := range c.Listeners {
+		key := fmt.Sprintf("listeners[%d]", i)
+		if l.ProxyProtocol && len(c.TrustedProxies) == 0 {
+			return fail(key+".proxyProtocol", errors.New("Needs trustedProxies"))
+		}
+		if l.MaxConns < 0 {
+			return fail(key+".maxConns", errors.New("Can't be negative"))
+		}
+		for _, addr := range []string{l.HTTP, l.HTTPS, l.Plain, l.Admin} {
+			if addr == "" {
+				continue
+			}
+			if l.ProxyProtocol {
+				opts.SetProxyProtocol(addr)
+			}
+			if l.MaxConns > 0 {
+				opts.SetMaxConns(addr, l.MaxConns)
+			}
+		}
+	}
+	for i, p := range c.TrustedProxies {
+		if err := opts.AddTrustedProxy(p); err != nil {
+			return fail(fmt.Sprintf("trustedProxies[%d]", i), err)
+		}
+	}
+
+	for i, h := range c.Hosts {
+		if err := checkHost(h); err != nil {
+			return fail(fmt.Sprintf("hosts[%d]", i), err)
+		}
+		opts.AddHost(h)
+	}
+
+	switch c.TLS.Mode {
+	case "":
+	case TLSAutocert, TLSDebug, TLSFiles:
+		opts.SetTLSMode(c.TLS.Mode)
+	default:
+		return fail("tls.mode", fmt.Errorf("Unknown mode %q", c.TLS.Mode))
+	}
+
+	if c.TLS.Mode == TLSFiles && len(c.TLS.Certs) == 0 {
+		return fail("tls.certs", errors.New("Files mode needs at least one certificate"))
+	}
+	if c.TLS.Mode != TLSFiles && len(c.TLS.Certs) != 0 {
+		return fail("tls.certs", fmt.Errorf("Only used when tls.mode is %q", TLSFiles))
+	}
+	for i, cf := range c.TLS.Certs {
+		key := fmt.Sprintf("tls.certs[%d]", i)
+		if cf.Cert == "" {
+			return fail(key+".cert", errors.New("Missing certificate file"))
+		}
+		if cf.Key == "" {
+			return fail(key+".key", errors.New("Missing key file"))
+		}
+		opts.AddCertFile(cf.Cert, cf.Key)
+	}
+
+	if c.ACME.CacheDir != "" {
+		opts.SetCertCache(c.ACME.CacheDir)
+	}
+	if c.ACME.Email != "" {
+		if !strings.Contains(c.ACME.Email, "@") {
+			return fail("acme.email", fmt.Errorf("%q isn't an email address", c.ACME.Email))
+		}
+		opts.SetACMEEmail(c.ACME.Email)
+	}
+	if c.ACME.CACert != "" && c.ACME.Directory == "" {
+		return fail("acme.caCert", errors.New("Only makes sense with acme.directory"))
+	}
+	if c.ACME.Directory != "" {
+		u, err := url.Parse(c.ACME.Directory)
+		if err == nil && (u.Scheme != "https" && u.Scheme != "http" || u.Host == "") {
+			err = errors.New("Should be an absolute http(s) URL")
+		}
+		if err != nil {
+			return fail("acme.directory", err)
+		}
+
+		var roots *x509.CertPool
+		if c.ACME.CACert != "" {
+			pem, err := ioutil.ReadFile(c.ACME.CACert)
+			if err != nil {
+				return fail("acme.caCert", err)
+			}
+			roots = x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(pem) {
+				return fail("acme.caCert", fmt.Errorf("No certificates found in %s", c.ACME.CACert))
+			}
+		}
+		opts.SetACMEDirectory(c.ACME.Directory, roots)
+	}
+
+	if c.PublicStatus {
+		opts.SetPublicStatus()
+	}
+	if c.RedirectStatus != 0 {
+		if err := opts.SetRedirectStatus(c.RedirectStatus); err != nil {
+			return fail("redirectStatus", err)
+		}
+	}
+
+	if c.HSTS.MaxAge != "" {
+		d, err := parseDuration(c.HSTS.MaxAge)
+		if err != nil {
+			return fail("hsts.maxAge", err)
+		}
+		opts.SetHSTS(HSTS{
+			MaxAge:            d,
+			IncludeSubdomains: c.HSTS.IncludeSubdomains,
+			Preload:           c.HSTS.Preload,
+		})
+	} else if c.HSTS.IncludeSubdomains || c.HSTS.Preload {
+		return fail("hsts.maxAge", errors.New("Needed when setting other hsts options"))
+	}
+
+	if strings.ContainsAny(c.Middleware.Security.ContentSecurityPolicy, "\r\n") {
+		return fail("middleware.security.contentSecurityPolicy", errors.New("Can't contain line breaks"))
+	}
+	if strings.ContainsAny(c.Middleware.Security.ReferrerPolicy, "\r\n") {
+		return fail("middleware.security.referrerPolicy", errors.New("Can't contain line breaks"))
+	}
+	opts.SetBuiltins(Builtins{
+		RequestID: c.Middleware.RequestID,
+		Recover:   c.Middleware.Recover,
+		Compress:  c.Middleware.Compress,
+		Security: SecurityHeaders{
+			ContentSecurityPolicy: c.Middleware.Security.ContentSecurityPolicy,
+			ReferrerPolicy:        c.Middleware.Security.ReferrerPolicy,
+			NoSniff:               c.Middleware.Security.NoSniff,
+		},
+	})
+
+	var lg Logging
+	switch c.Logging.Format {
+	case "", "text":
+	case "json":
+		lg.JSON = true
+	default:
+		return fail("logging.format", fmt.Errorf("Unknown format %q, expected text or json", c.Logging.Format))
+	}
+	if c.Logging.Level != "" {
+		if err := lg.Level.UnmarshalText([]byte(c.Logging.Level)); err != nil {
+			return fail("logging.level", err)
+		}
+	}
+	for name, raw := range c.Logging.Levels {
+		key := "logging.levels." + name
+		if !knownLogger(name) {
+			return fail(key, fmt.Errorf("Unknown logger, expected one of %s", strings.Join(loggerNames, ", ")))
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(raw)); err != nil {
+			return fail(key, err)
+		}
+		if lg.Levels == nil {
+			lg.Levels = make(map[string]slog.Level)
+		}
+		lg.Levels[name] = l
+	}
+	opts.SetLogging(lg)
+
+	t, err := c.Timeouts.parse(path, "timeouts")
+	if err != nil {
+		return Options{}, err
+	}
+	opts.SetTimeouts(t)
+
+	t, err = c.RedirectTimeouts.parse(path, "redirectTimeouts")
+	if err != nil {
+		return Options{}, err
+	}
+	opts.SetRedirectTimeouts(t)
+
+	var st ShutdownTimeouts
+	if c.Shutdown.Delay != "" {
+		if st.Delay, err = parseDuration(c.Shutdown.Delay); err != nil {
+			return fail("shutdown.delay", err)
+		}
+	}
+	if c.Shutdown.Drain != "" {
+		if st.Drain, err = parseDuration(c.Shutdown.Drain); err != nil {
+			return fail("shutdown.drain", err)
+		}
+	}
+	if c.Shutdown.Hook != "" {
+		if st.Hook, err = parseDuration(c.Shutdown.Hook); err != nil {
+			return fail("shutdown.hook", err)
+		}
+	}
+	opts.SetShutdownTimeouts(st)
+
+	for name, p := range c.Handlers {
+		if !strings.HasPrefix(p, "/") {
+			return fail("handlers."+name, fmt.Errorf("Path %q must start with /", p))
+		}
+		opts.SetMount(name, p)
+	}
+	if c.Handlers != nil && opts.mounts == nil {
+		// An empty handlers block means mount nothing
+		opts.mounts = make(map[string]string)
+	}
+
+	for i, v := range c.VirtualHosts {
+		key := fmt.Sprintf("virtualHosts[%d]", i)
+		if v.Host == "" {
+			return fail(key+".host", errors.New("Missing host"))
+		}
+		if v.RedirectTo == "" && len(v.Handlers) == 0 {
+			return fail(key, errors.New("Need handlers or redirectTo"))
+		}
+		for name, p := range v.Handlers {
+			if !strings.HasPrefix(p, "/") {
+				return fail(key+".handlers."+name, fmt.Errorf("Path %q must start with /", p))
+			}
+		}
+		err := opts.AddVirtualHost(VirtualHost{Host: v.Host, Mounts: v.Handlers, RedirectTo: v.RedirectTo})
+		if err != nil {
+			return fail(key, err)
+		}
+	}
+
+	for i, l := range c.RateLimits {
+		key := fmt.Sprintf("rateLimits[%d]", i)
+		rate, err := parseRate(l.Rate)
+		if err != nil {
+			return fail(key+".rate", err)
+		}
+		err = opts.AddRateLimit(RateLimit{Path: l.Path, Rate: rate, Burst: l.Burst, By: l.By})
+		if err != nil {
+			return fail(key, err)
+		}
+	}
+
+	// What's mounted where, by host and path, so proxies don't clash
+	// with handlers or each other. http.ServeMux panics if they do
+	type mountPoint struct{ host, path string }
+	used := make(map[mountPoint]string)
+	for name, p := range opts.Mounts() {
+		used[mountPoint{"", p}] = "handlers." + name
+	}
+	for i, v := range c.VirtualHosts {
+		for name, p := range v.Handlers {
+			used[mountPoint{strings.ToLower(v.Host), p}] = fmt.Sprintf("virtualHosts[%d].handlers.%s", i, name)
+		}
+	}
+
+	for i, p := range c.Proxies {
+		key := fmt.Sprintf("proxies[%d]", i)
+		at := mountPoint{strings.ToLower(p.Host), p.Path}
+		if other, ok := used[at]; ok {
+			return fail(key+".path", fmt.Errorf("Path %q is already used by %s", p.Path, other))
+		}
+		used[at] = key
+		proxy := Proxy{
+			Path:        p.Path,
+			Host:        p.Host,
+			Upstreams:   p.Upstreams,
+			StripPrefix: p.StripPrefix,
+			Balance:     p.Balance,
+			HealthCheck: p.HealthCheck,
+		}
+		if p.HealthInterval != "" {
+			if proxy.HealthInterval, err = parseDuration(p.HealthInterval); err != nil {
+				return fail(key+".healthInterval", err)
+			}
+		}
+		if err := opts.AddProxy(proxy); err != nil {
+			return fail(key, err)
+		}
+	}
+
+	return opts, nil
+}
+
+func (t timeoutConfig) parse(file, prefix string) (Timeouts, error) {
+	var out Timeouts
+	fields := []struct {
+		key string
+		raw string
+		dst *time.Duration
+	}{
+		{"read", t.Read, &out.Read},
+		{"write", t.Write, &out.Write},
+		{"idle", t.Idle, &out.Idle},
+	}
+	for _, f := range fields {
+		if f.raw == "" {
+			continue
+		}
+		d, err := parseDuration(f.raw)
+		if err != nil {
+			return out, &ConfigError{File: file, Key: prefix + "." + f.key, Err: err}
+		}
+		*f.dst = d
+	}
+	return out, nil
+}
+
+// parseDuration parses things like "15s", which must not be negative
+func parseDuration(raw string) (time.Duration, error) {
+	d, err := time.ParseDuration(raw)
+	if err == nil && d < 0 {
+		err = errors.New("Duration can't be negative")
+	}
+	return d, err
+}
+
+func knownLogger(name string) bool {
+	for _, n := range loggerNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost makes sure h is a bare hostname
+func checkHost(h string) error {
+	if h == "" {
+		return errors.New("Hostname can't be empty")
+	}
+	if strings.ContainsAny(h, ":/ ") {
+		return fmt.Errorf("%q should be a bare hostname", h)
+	}
+	return nil
+}
+
+// decodeError turns errors from encoding/json into ConfigErrors
+// that say where in the file things went wrong. offset is how far the
+// decoder got
+func decodeError(path string, raw []byte, offset int64, err error) error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return &ConfigError{File: path, Key: lineCol(raw, e.Offset), Err: err}
+	case *json.UnmarshalTypeError:
+		return &ConfigError{File: path, Key: e.Field, Err: fmt.Errorf("Expected %s, got %s", e.Type, e.Value)}
+	}
+
+	msg := err.Error()
+	if strings.HasPrefix(msg, "json: unknown field ") {
+		// The error only has the name, so find where it is
+		key, found := unknownKey(raw, reflect.TypeOf(config{}))
+		if !found {
+			name, _ := strconv.Unquote(strings.TrimPrefix(msg, "json: unknown field "))
+			key = name + " at " + lineCol(raw, offset)
+		}
+		return &ConfigError{File: path, Key: key, Err: errors.New("Unknown key")}
+	}
+	return &ConfigError{File: path, Err: err}
+}
+
+// unknownKey gives the dotted path, like acme.email, to the first key
+// in raw that t doesn't have
+func unknownKey(raw []byte, t reflect.Type) (string, bool) {
+	return findUnknown(json.NewDecoder(bytes.NewReader(raw)), t, "")
+}
+
+// findUnknown reads one value from dec that should fit t, looking for
+// keys that t doesn't have. A nil t takes anything
+func findUnknown(dec *json.Decoder, t reflect.Type, path string) (string, bool) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return "", false
+	}
+	switch tok {
+	case json.Delim('['):
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		for i := 0; dec.More(); i++ {
+			if key, found := findUnknown(dec, elem, fmt.Sprintf("%s[%d]", path, i)); found {
+				return key, true
+			}
+		}
+		dec.Token()
+	case json.Delim('{'):
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return "", false
+			}
+			name, _ := tok.(string)
+			key := name
+			if path != "" {
+				key = path + "." + name
+			}
+
+			var field reflect.Type
+			if t != nil {
+				switch t.Kind() {
+				case reflect.Struct:
+					var ok bool
+					if field, ok = jsonField(t, name); !ok {
+						return key, true
+					}
+				case reflect.Map:
+					field = t.Elem()
+				}
+			}
+			if key, found := findUnknown(dec, field, key); found {
+				return key, true
+			}
+		}
+		dec.Token()
+	}
+	return "", false
+}
+
+// jsonField finds the type of the field that encoding/json would
+// decode name into
+func jsonField(t reflect.Type, name string) (reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == "-" || f.PkgPath != "" {
+			continue
+		}
+		if tag == "" {
+			tag = f.Name
+		}
+		if strings.EqualFold(tag, name) {
+			return f.Type, true
+		}
+	}
+	return nil, false
+}
+
+func lineCol(raw []byte, offset int64) string {
+	if offset > int64(len(raw)) {
+		offset = int64(len(raw))
+	}
+	before := raw[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(offset) - bytes.LastIndexByte(before, '\n') - 1
+	return fmt.Sprintf("line %d, column %d", line, col)
+}
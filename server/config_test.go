@@ -0,0 +1,204 @@
+package server
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOptions(t *testing.T) {
+	raw := `{
+	"listeners": [
+		{"http": ":8080", "https": ":8443"},
+		{"https": ":9443", "maxConns": 100},
+		{"plain": "unix:/run/mm.sock"},
+		{"admin": "127.0.0.1:9100"}
+	],
+	"trustedProxies": ["10.0.0.0/8", "192.0.2.1", "unix"],
+	"rateLimits": [{"path": "/eveapi/api", "rate": "30/m", "burst": 10, "by": "user"}],
+	"hosts": ["example.com"],
+	"tls": {"mode": "debug"},
+	"acme": {"cacheDir": "/var/cache/certs", "email": "admin@example.com", "directory": "https://localhost:14000/dir"},
+	"timeouts": {"read": "10s"},
+	"redirectStatus": 308,
+	"publicStatus": true,
+	"hsts": {"maxAge": "8760h", "includeSubdomains": true},
+	"logging": {"format": "json", "level": "warn", "levels": {"eveapi": "debug"}},
+	"handlers": {"static": "/", "linkshare": "/ws"}
+}`
+	opts, err := parseOptions("test.json", []byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []listener{
+		{kind: listenRedirect, addr: ":8080", redirectTo: ":8443"},
+		{kind: listenHTTPS, addr: ":8443"},
+		{kind: listenHTTPS, addr: ":9443", maxConns: 100},
+		{kind: listenHTTP, addr: "unix:/run/mm.sock"},
+		{kind: listenAdmin, addr: "127.0.0.1:9100"},
+	}
+	if len(opts.listeners) != len(expected) {
+		t.Fatalf("Expected %d listeners, got %+v", len(expected), opts.listeners)
+	}
+	for i, l := range expected {
+		if opts.listeners[i] != l {
+			t.Errorf("Listener %d: expected %+v, got %+v", i, l, opts.listeners[i])
+		}
+	}
+	if len(opts.trustedProxies) != 2 || !opts.trustUnix || !opts.trustedAddr("192.0.2.1:80") {
+		t.Errorf("Trusted proxies wrong: %v %v", opts.trustedProxies, opts.trustUnix)
+	}
+	if len(opts.rateLimits) != 1 || opts.rateLimits[0] != (RateLimit{Path: "/eveapi/api", Rate: 0.5, Burst: 10, By: LimitByUser}) {
+		t.Errorf("Rate limits wrong: %+v", opts.rateLimits)
+	}
+	if opts.getTLSMode() != TLSDebug {
+		t.Errorf("TLS mode should be debug, got %s", opts.getTLSMode())
+	}
+	if h := opts.getHosts(); len(h) != 1 || h[0] != "example.com" {
+		t.Errorf("Hosts not set: %v", h)
+	}
+
+	if opts.getCertCache() != "/var/cache/certs" || opts.acmeEmail != "admin@example.com" || opts.acmeDirectory != "https://localhost:14000/dir" {
+		t.Errorf("ACME options not set: %s %s %s", opts.getCertCache(), opts.acmeEmail, opts.acmeDirectory)
+	}
+
+	if opts.getRedirectStatus() != 308 {
+		t.Errorf("Redirect status should be 308, got %d", opts.getRedirectStatus())
+	}
+	if !opts.publicStatus {
+		t.Error("publicStatus not set")
+	}
+	if h := opts.hsts.String(); h != "max-age=31536000; includeSubDomains" {
+		t.Errorf("Unexpected HSTS header %q", h)
+	}
+
+	if !opts.logging.JSON || opts.logging.Level != slog.LevelWarn || opts.logging.Levels["eveapi"] != slog.LevelDebug {
+		t.Errorf("Logging not set: %+v", opts.logging)
+	}
+
+	to := opts.timeouts.orDefault(defaultTimeouts)
+	if to.Read != 10*time.Second || to.Write != defaultTimeouts.Write {
+		t.Errorf("Timeouts wrong: %+v", to)
+	}
+
+	m := opts.Mounts()
+	if len(m) != 2 || m["linkshare"] != "/ws" {
+		t.Errorf("Mounts wrong: %v", m)
+	}
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+	tests := []struct {
+		raw string
+		key string
+	}{
+		{`{"listeners": [{"http": ":80", "https": "nope"}]}`, "listeners[0].https"},
+		{`{"listeners": [{}]}`, "listeners[0]"},
+		{`{"listeners": [{"plain": ":80", "https": ":443"}]}`, "listeners[0]"},
+		{`{"listeners": [{"plain": "unix:"}]}`, "listeners[0].plain"},
+		{`{"listeners": [{"admin": ":9100", "plain": ":80"}]}`, "listeners[0]"},
+		{`{"listeners": [{"admin": "localhost"}]}`, "listeners[0].admin"},
+		{`{"hosts": ["ok.com", "http://bad.com"]}`, "hosts[1]"},
+		{`{"tls": {"mode": "magic"}}`, "tls.mode"},
+		{`{"tls": {"mode": "files"}}`, "tls.certs"},
+		{`{"tls": {"certs": [{"cert": "a.pem", "key": "a.key"}]}}`, "tls.certs"},
+		{`{"tls": {"mode": "files", "certs": [{"cert": "a.pem", "key": "a.key"}, {"cert": "b.pem"}]}}`, "tls.certs[1].key"},
+		{`{"acme": {"email": "nobody"}}`, "acme.email"},
+		{`{"acme": {"directory": "localhost:14000/dir"}}`, "acme.directory"},
+		{`{"acme": {"caCert": "pebble.pem"}}`, "acme.caCert"},
+		{`{"acme": {"directory": "https://localhost:14000/dir", "caCert": "missing.pem"}}`, "acme.caCert"},
+		{`{"redirectStatus": 200}`, "redirectStatus"},
+		{`{"hsts": {"maxAge": "a year"}}`, "hsts.maxAge"},
+		{`{"hsts": {"preload": true}}`, "hsts.maxAge"},
+		{`{"timeouts": {"write": "soon"}}`, "timeouts.write"},
+		{`{"redirectTimeouts": {"idle": "-1s"}}`, "redirectTimeouts.idle"},
+		{`{"shutdown": {"delay": "soon"}}`, "shutdown.delay"},
+		{`{"shutdown": {"drain": "forever"}}`, "shutdown.drain"},
+		{`{"shutdown": {"hook": "-5s"}}`, "shutdown.hook"},
+		{`{"logging": {"format": "xml"}}`, "logging.format"},
+		{`{"logging": {"level": "loud"}}`, "logging.level"},
+		{`{"logging": {"levels": {"eveapi": "debug", "nope": "info"}}}`, "logging.levels.nope"},
+		{`{"handlers": {"static": "www"}}`, "handlers.static"},
+		{`{"virtualHosts": [{"handlers": {"static": "/"}}]}`, "virtualHosts[0].host"},
+		{`{"virtualHosts": [{"host": "a.com"}]}`, "virtualHosts[0]"},
+		{`{"virtualHosts": [{"host": "a.*.com", "redirectTo": "a.com"}]}`, "virtualHosts[0]"},
+		{`{"virtualHosts": [{"host": "www.a.com", "redirectTo": "a.com", "handlers": {"static": "/"}}]}`, "virtualHosts[0]"},
+		{`{"virtualHosts": [{"host": "a.com", "handlers": {"eveapi": "eve"}}]}`, "virtualHosts[0].handlers.eveapi"},
+		{`{"virtualHosts": [{"host": "a.com", "redirectTo": "b.com"}, {"host": "A.com", "redirectTo": "c.com"}]}`, "virtualHosts[1]"},
+		{`{"proxies": [{"path": "/ci/"}]}`, "proxies[0]"},
+		{`{"proxies": [{"path": "/ci/", "upstreams": ["localhost:8080"]}]}`, "proxies[0]"},
+		{`{"proxies": [{"path": "/ci/", "upstreams": ["http://localhost:8080"], "balance": "random"}]}`, "proxies[0]"},
+		{`{"proxies": [{"path": "/ci/", "upstreams": ["http://localhost:8080"], "healthInterval": "often"}]}`, "proxies[0].healthInterval"},
+		{`{"proxies": [{"path": "/", "upstreams": ["http://localhost:8080"]}]}`, "proxies[0].path"},
+		{`{"handlers": {"static": "/"}, "proxies": [{"path": "/ci/", "upstreams": ["http://a"]}, {"path": "/ci/", "upstreams": ["http://b"]}]}`, "proxies[1].path"},
+		{`{"virtualHosts": [{"host": "ci.example.com", "handlers": {"static": "/"}}], "proxies": [{"path": "/", "host": "CI.example.com", "upstreams": ["http://a"]}]}`, "proxies[0].path"},
+		{`{"trustedProxies": ["10.0.0.0/8", "10.0.0.1/40"]}`, "trustedProxies[1]"},
+		{`{"trustedProxies": ["proxy.local"]}`, "trustedProxies[0]"},
+		{`{"listeners": [{"plain": ":80", "proxyProtocol": true}]}`, "listeners[0].proxyProtocol"},
+		{`{"listeners": [{"plain": ":80", "maxConns": -1}]}`, "listeners[0].maxConns"},
+		{`{"rateLimits": [{"path": "/api", "rate": "10"}]}`, "rateLimits[0].rate"},
+		{`{"rateLimits": [{"path": "/api", "rate": "10/d"}]}`, "rateLimits[0].rate"},
+		{`{"rateLimits": [{"path": "/api", "rate": "-1/s"}]}`, "rateLimits[0].rate"},
+		{`{"rateLimits": [{"path": "/api", "rate": "1/s", "by": "cookie"}]}`, "rateLimits[0]"},
+		{`{"rateLimits": [{"path": "/api", "rate": "1/s"}, {"path": "/api", "rate": "2/s"}]}`, "rateLimits[1]"},
+		{`{"lisenters": []}`, "lisenters"},
+		{`{"acme": {"bogus": 1}}`, "acme.bogus"},
+		{`{"listeners": [{"plain": ":80"}, {"plain": ":81", "bogus": true}]}`, "listeners[1].bogus"},
+		{`{"virtualHosts": [{"host": "a.com", "handlers": {"static": "/"}, "Redirect": "b.com"}]}`, "virtualHosts[0].Redirect"},
+		{`{"logging": {"levels": {"eveapi": "debug"}, "colour": true}}`, "logging.colour"},
+		{`{"debug": "yes"}`, "debug"},
+		{"{\n  \"debug\": true,,\n}", "line 2, column 17"},
+	}
+
+	for _, tc := range tests {
+		_, err := parseOptions("test.json", []byte(tc.raw))
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.raw)
+			continue
+		}
+		ce, ok := err.(*ConfigError)
+		if !ok {
+			t.Errorf("%s: expected a ConfigError, got %T", tc.raw, err)
+			continue
+		}
+		if ce.Key != tc.key {
+			t.Errorf("%s: expected key %q, got %q (%v)", tc.raw, tc.key, ce.Key, err)
+		}
+		if !strings.HasPrefix(err.Error(), "test.json: ") {
+			t.Errorf("%s: error should name the file: %v", tc.raw, err)
+		}
+	}
+}
+
+func TestEmptyHandlers(t *testing.T) {
+	opts, err := parseOptions("test.json", []byte(`{"handlers": {}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := opts.Mounts(); len(m) != 0 {
+		t.Errorf("Expected no mounts, got %v", m)
+	}
+
+	var defaults Options
+	if m := defaults.Mounts(); len(m) != len(defaultMounts) {
+		t.Errorf("Expected default mounts, got %v", m)
+	}
+}
+
+func TestParseVirtualHosts(t *testing.T) {
+	raw := `{"virtualHosts": [
+		{"host": "www.example.com", "redirectTo": "example.com"},
+		{"host": "*.example.com", "handlers": {"linkshare": "/ws"}}
+	]}`
+	opts, err := parseOptions("test.json", []byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := opts.VirtualHosts()
+	if len(v) != 2 || v[0].RedirectTo != "example.com" || v[1].Host != "*.example.com" || v[1].Mounts["linkshare"] != "/ws" {
+		t.Errorf("Virtual hosts wrong: %+v", v)
+	}
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files with these extensions are fingerprinted
+var fingerprintExts = map[string]bool{".css": true, ".js": true}
+
+// href and src attributes in HTML, quoted or not
+var assetRef = regexp.MustCompile(`(?i)(\s(?:href|src)\s*=\s*)("[^"]*"|'[^']*'|[^\s"'>]+)`)
+
+// page is a file served from memory: a fingerprinted asset as it was
+// when it was hashed, or an HTML page with its links changed
+type page struct {
+	data    []byte
+	modTime time.Time
+	etag    string
+	// the size of the file the page was made from, to tell when it's
+	// changed
+	size int64
+	// for assets, the original name
+	name string
+	// for HTML pages, the fingerprinted names the links were changed
+	// to, by original name
+	links map[string]string
+}
+
+// fingerprints are the results of Static.Fingerprint
+type fingerprints struct {
+	fsys fs.FS
+
+	mu sync.Mutex
+	// fingerprinted name by original name
+	hashed map[string]string
+	// the contents that were hashed, by fingerprinted name, so a
+	// fingerprinted name always gives the same bytes
+	assets map[string]*page
+	// rewritten HTML, by name, made when it's first asked for and again
+	// when the file or an asset it links to changes. nil data means the
+	// page has no links to change
+	pages map[string]*page
+}
+
+// Fingerprint gives every CSS and JS file a second name with a hash of
+// its contents in it, like css/core.3f2a9c1b0d4e5f67.css, which is
+// cached for a year. Links to the files from HTML pages are changed to
+// the new names as the pages are served. When a file changes it's
+// hashed again as soon as it's asked for, and the old name stops
+// working. It should be called before the handler is used, and again to
+// pick up new CSS and JS files
+func (h *Static) Fingerprint() error {
+	f := &fingerprints{
+		fsys:   h.fsys,
+		hashed: make(map[string]string),
+		assets: make(map[string]*page),
+		pages:  make(map[string]*page),
+	}
+
+	err := fs.WalkDir(h.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name != "." && hidden(name) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		if !fingerprintExts[path.Ext(name)] || fingerprinted.MatchString(name) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		a, err := f.hash(name, info)
+		if err != nil {
+			return err
+		}
+		f.store(a, "")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Fingerprinted assets", "assets", len(f.hashed))
+	h.mu.Lock()
+	h.fingerprints = f
+	h.mu.Unlock()
+	return nil
+}
+
+// hash reads an asset and gives it a fingerprinted name
+func (f *fingerprints) hash(name string, info fs.FileInfo) (*page, error) {
+	b, err := fs.ReadFile(f.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return &page{
+		data:    b,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		etag:    `"` + hex.EncodeToString(sum[:16]) + `"`,
+		name:    name,
+		links:   map[string]string{name: fingerprintName(name, sum[:8])},
+	}, nil
+}
+
+func fingerprintName(name string, sum []byte) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum) + ext
+}
+
+// store adds a hashed asset, replacing the one with the fingerprinted
+// name old. If old has already been replaced, a is dropped
+func (f *fingerprints) store(a *page, old string) {
+	hashed := a.links[a.name]
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.hashed[a.name] != old {
+		return
+	}
+	delete(f.assets, old)
+	f.hashed[a.name] = hashed
+	f.assets[hashed] = a
+}
+
+// current gives the fingerprinted name for an asset, hashing it again
+// if it has changed. ok is false if the file isn't fingerprinted
+func (f *fingerprints) current(name string) (hashed string, ok bool) {
+	f.mu.Lock()
+	hashed, ok = f.hashed[name]
+	a := f.assets[hashed]
+	f.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+
+	info, err := fs.Stat(f.fsys, name)
+	if err != nil || (info.Size() == a.size && info.ModTime().Equal(a.modTime)) {
+		// Unchanged, or gone, in which case the last contents will do
+		return hashed, true
+	}
+	changed, err := f.hash(name, info)
+	if err != nil {
+		logger.Warn("Can't fingerprint changed file", "file", name, "err", err)
+		return hashed, true
+	}
+	logger.Debug("Fingerprinting changed file", "file", name, "was", hashed, "now", changed.links[name])
+	f.store(changed, hashed)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hashed[name], true
+}
+
+// asset gives the contents for a fingerprinted name, as long as it's
+// still the name for the file as it is now
+func (f *fingerprints) asset(hashed string) *page {
+	f.mu.Lock()
+	a := f.assets[hashed]
+	f.mu.Unlock()
+	if a == nil {
+		return nil
+	}
+	if now, _ := f.current(a.name); now != hashed {
+		return nil
+	}
+	return a
+}
+
+// page gives an HTML page with its links changed, or nil if it doesn't
+// have any links to change
+func (f *fingerprints) page(name string, info fs.FileInfo) (*page, error) {
+	f.mu.Lock()
+	p, ok := f.pages[name]
+	f.mu.Unlock()
+	if ok && p.size == info.Size() && p.modTime.Equal(info.ModTime()) && f.linksCurrent(p) {
+		if p.data == nil {
+			return nil, nil
+		}
+		return p, nil
+	}
+
+	b, err := fs.ReadFile(f.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	p = &page{modTime: info.ModTime(), size: info.Size(), links: make(map[string]string)}
+	if out := f.rewrite(name, b, p.links); !bytes.Equal(out, b) {
+		sum := sha256.Sum256(out)
+		p.data = out
+		p.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	}
+
+	f.mu.Lock()
+	f.pages[name] = p
+	f.mu.Unlock()
+	if p.data == nil {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// linksCurrent checks that the assets a page links to haven't changed
+// since it was made
+func (f *fingerprints) linksCurrent(p *page) bool {
+	for name, hashed := range p.links {
+		if now, _ := f.current(name); now != hashed {
+			return false
+		}
+	}
+	return true
+}
+
+// rewrite changes links to fingerprinted files in an HTML page, noting
+// the names it used in links
+func (f *fingerprints) rewrite(name string, html []byte, links map[string]string) []byte {
+	return assetRef.ReplaceAllFunc(html, func(m []byte) []byte {
+		parts := assetRef.FindSubmatch(m)
+		attr, value := string(parts[1]), string(parts[2])
+
+		quote := ""
+		if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'") {
+			quote = value[:1]
+			value = value[1 : len(value)-1]
+		}
+
+		ref, suffix := value, ""
+		if i := strings.IndexAny(ref, "?#"); i >= 0 {
+			ref, suffix = ref[:i], ref[i:]
+		}
+		if ref == "" || strings.Contains(ref, ":") || strings.HasPrefix(ref, "//") {
+			// Not a link to a file on this site
+			return m
+		}
+
+		target := ref
+		if !strings.HasPrefix(target, "/") {
+			target = path.Join("/", path.Dir(name), target)
+		}
+		asset := strings.TrimPrefix(path.Clean(target), "/")
+		hashed, ok := f.current(asset)
+		if !ok {
+			return m
+		}
+		links[asset] = hashed
+		ref = strings.TrimSuffix(ref, path.Base(ref)) + path.Base(hashed)
+		return []byte(attr + quote + ref + suffix + quote)
+	})
+}
+
+// AssetPath gives the fingerprinted path for an absolute path to a file,
+// like /css/core.css, or the path itself if the file isn't fingerprinted
+func (h *Static) AssetPath(p string) string {
+	f := h.getFingerprints()
+	if f == nil {
+		return p
+	}
+	if hashed, ok := f.current(strings.TrimPrefix(p, "/")); ok {
+		return "/" + hashed
+	}
+	return p
+}
+
+func (h *Static) getFingerprints() *fingerprints {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.fingerprints
+}
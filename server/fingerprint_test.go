@@ -0,0 +1,123 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestFingerprint(t *testing.T) {
+	h := NewStatic(fstest.MapFS{
+		"index.html": {Data: []byte(`<link rel="stylesheet" href="css/core.css">` +
+			`<script src='/js/app.js?v=1'></script><a href=eve/>eve</a>` +
+			`<img src="https://example.com/js/app.js">`)},
+		"eve/index.html":             {Data: []byte(`<link href="../css/core.css"><script src="eve.js"></script>`)},
+		"eve/eve.js":                 {Data: []byte("eve()")},
+		"eve/eve.js.gz":              {Data: []byte("gzipped")},
+		"css/core.css":               {Data: []byte("body {}")},
+		"js/app.js":                  {Data: []byte("app()")},
+		"js/old.0123456789abcdef.js": {Data: []byte("old()")},
+		"about.html":                 {Data: []byte("<p>no links</p>")},
+	})
+	if err := h.Fingerprint(); err != nil {
+		t.Fatal(err)
+	}
+
+	css := h.AssetPath("/css/core.css")
+	app := h.AssetPath("/js/app.js")
+	eve := h.AssetPath("/eve/eve.js")
+	for _, p := range []string{css, app, eve} {
+		if !fingerprinted.MatchString(p) {
+			t.Fatalf("%s isn't fingerprinted", p)
+		}
+	}
+	if p := h.AssetPath("/js/old.0123456789abcdef.js"); p != "/js/old.0123456789abcdef.js" {
+		t.Errorf("Already fingerprinted file renamed to %s", p)
+	}
+
+	w := getStatic(h, "/")
+	expected := `<link rel="stylesheet" href="` + css[1:] + `">` +
+		`<script src='` + app + `?v=1'></script><a href=eve/>eve</a>` +
+		`<img src="https://example.com/js/app.js">`
+	if w.Body.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, w.Body.String())
+	}
+	if w.Header().Get("Cache-Control") != cacheRevalidate || w.Header().Get("ETag") == "" {
+		t.Errorf("Pages should be revalidated, got %v", w.Header())
+	}
+
+	w = getStatic(h, "/eve/", "Accept-Encoding", "gzip")
+	expected = `<link href="../` + css[1:] + `"><script src="` + eve[len("/eve/"):] + `"></script>`
+	if w.Body.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, w.Body.String())
+	}
+
+	w = getStatic(h, css)
+	if w.Code != http.StatusOK || w.Body.String() != "body {}" {
+		t.Errorf("%s: got %d %q", css, w.Code, w.Body.String())
+	}
+	if w.Header().Get("Cache-Control") != cacheImmutable || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/css") {
+		t.Errorf("%s: wrong headers %v", css, w.Header())
+	}
+
+	// Precompressed copies weren't hashed, so they aren't used
+	w = getStatic(h, eve, "Accept-Encoding", "gzip")
+	if w.Body.String() != "eve()" || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("%s: expected the hashed copy, got %q", eve, w.Body.String())
+	}
+
+	// The old names still work
+	w = getStatic(h, "/css/core.css")
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != cacheRevalidate {
+		t.Errorf("/css/core.css: got %d %v", w.Code, w.Header())
+	}
+
+	w = getStatic(h, "/css/core.0000000000000000.css")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Made up fingerprint: expected 404, got %d", w.Code)
+	}
+}
+
+func TestFingerprintEdits(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html":   {Data: []byte(`<link href="/css/core.css">`)},
+		"css/core.css": {Data: []byte("body {}")},
+	}
+	h := NewStatic(fsys)
+	if err := h.Fingerprint(); err != nil {
+		t.Fatal(err)
+	}
+	css := h.AssetPath("/css/core.css")
+
+	fsys["css/core.css"] = &fstest.MapFile{Data: []byte("body { color: red }"), ModTime: time.Now()}
+	fsys["index.html"] = &fstest.MapFile{Data: []byte(`<h1>New</h1><link href="/css/core.css">`), ModTime: time.Now()}
+
+	// The edited CSS gets a new fingerprint, and the old one stops working
+	if w := getStatic(h, css); w.Code != http.StatusNotFound {
+		t.Errorf("Old fingerprint: expected 404, got %d", w.Code)
+	}
+	edited := h.AssetPath("/css/core.css")
+	if edited == css {
+		t.Fatal("Expected a new fingerprint")
+	}
+	if w := getStatic(h, edited); w.Body.String() != "body { color: red }" || w.Header().Get("Cache-Control") != cacheImmutable {
+		t.Errorf("%s: expected the edited file, got %q", edited, w.Body.String())
+	}
+	if w := getStatic(h, "/css/core.css"); w.Body.String() != "body { color: red }" {
+		t.Errorf("/css/core.css: expected the edited file, got %q", w.Body.String())
+	}
+	// Edited pages are picked up, with their links changed
+	if w := getStatic(h, "/"); w.Body.String() != `<h1>New</h1><link href="`+edited+`">` {
+		t.Errorf("Expected the edited page, got %q", w.Body.String())
+	}
+
+	// Pages that haven't changed are made again when their CSS does
+	fsys["css/core.css"] = &fstest.MapFile{Data: []byte("body { color: blue }"), ModTime: time.Now().Add(time.Second)}
+	w := getStatic(h, "/")
+	again := h.AssetPath("/css/core.css")
+	if again == edited || w.Body.String() != `<h1>New</h1><link href="`+again+`">` {
+		t.Errorf("Expected a link to %s, got %q", again, w.Body.String())
+	}
+}
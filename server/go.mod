@@ -1,6 +1,7 @@
 module github.com/moosemorals/mm/server
 
 require (
-	github.com/gorilla/handlers v1.4.0
+	github.com/andybalholm/brotli v1.0.6
+	github.com/pires/go-proxyproto v0.7.0
 	golang.org/x/crypto v0.0.0-20181112202954-3d3f9f413869
 )
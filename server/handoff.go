@@ -0,0 +1,224 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Listening sockets can be passed to the server by systemd socket
+// activation, or by an older copy of the server handing over to a new
+// one on SIGUSR2. Both use the systemd protocol: LISTEN_FDS sockets
+// starting at fd 3, named by LISTEN_FDNAMES. Sockets are matched to
+// listeners by name, or failing that by address. Systemd sets LISTEN_PID
+// to the pid of the new process, which a parent using os/exec can't
+// know in advance, so a handoff sets handoffEnv to the parent's pid.
+
+const (
+	listenFdsStart = 3
+	handoffEnv     = "LISTEN_HANDOFF_PPID"
+)
+
+type inherited struct {
+	name string
+	ln   net.Listener
+}
+
+// filer is implemented by *net.TCPListener and *net.UnixListener
+type filer interface {
+	File() (*os.File, error)
+}
+
+// inheritListeners picks up any listening sockets passed to the process
+func inheritListeners() ([]inherited, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+
+	pid := os.Getenv("LISTEN_PID")
+	if pid != strconv.Itoa(os.Getpid()) && (pid != "" || handoffParent() == 0) {
+		// Meant for someone else
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("Bad LISTEN_FDS %q", fds)
+	}
+
+	var names []string
+	if raw := os.Getenv("LISTEN_FDNAMES"); raw != "" {
+		names = strings.Split(raw, ":")
+	}
+
+	var result []inherited
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("listen-fd-%d", fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("fd %d isn't a listening socket: %v", fd, err)
+		}
+
+		in := inherited{ln: ln}
+		if i < len(names) {
+			// Our addresses can have colons in, so a handoff escapes them
+			if in.name, err = url.QueryUnescape(names[i]); err != nil {
+				in.name = names[i]
+			}
+		}
+		result = append(result, in)
+	}
+	return result, nil
+}
+
+// handoffParent gives the pid of the parent that handed its sockets
+// over to us, or zero if there wasn't one
+func handoffParent() int {
+	ppid, err := strconv.Atoi(os.Getenv(handoffEnv))
+	if err != nil || ppid != os.Getppid() {
+		return 0
+	}
+	return ppid
+}
+
+// takeInherited removes and returns the inherited listener for addr, if any.
+// Listeners are matched by name first, then by address
+func takeInherited(pool []inherited, addr string) (net.Listener, []inherited) {
+	for i, in := range pool {
+		if in.name == addr {
+			return in.ln, append(pool[:i:i], pool[i+1:]...)
+		}
+	}
+	for i, in := range pool {
+		if sameAddr(addr, in.ln.Addr()) {
+			return in.ln, append(pool[:i:i], pool[i+1:]...)
+		}
+	}
+	return nil, pool
+}
+
+// sameAddr checks if a listener bound to actual would do for addr
+func sameAddr(addr string, actual net.Addr) bool {
+	network, address := splitNetwork(addr)
+	if network != actual.Network() {
+		return false
+	}
+	if network == "unix" {
+		return address == actual.String()
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	aHost, aPort, err := net.SplitHostPort(actual.String())
+	if err != nil || port != aPort {
+		return false
+	}
+
+	aIP := net.ParseIP(aHost)
+	if host == "" {
+		return aIP != nil && aIP.IsUnspecified()
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(aIP)
+}
+
+// handoff starts a new copy of the server, passing it our listening
+// sockets. Once the new copy is serving it sends us SIGTERM, and we
+// shut down as normal. The channel is closed if the new copy exits
+func (s *Server) handoff() (<-chan struct{}, error) {
+	if len(s.sockets) == 0 {
+		return nil, errors.New("Not listening yet")
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var names []string
+	for i, ln := range s.sockets {
+		fl, ok := ln.(filer)
+		if !ok {
+			return nil, fmt.Errorf("Can't pass %s on", s.servers[i].Addr)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		names = append(names, url.QueryEscape(s.servers[i].Addr))
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "LISTEN_") {
+			cmd.Env = append(cmd.Env, e)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		handoffEnv+"="+strconv.Itoa(os.Getpid()),
+	)
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	s.log.Info("Started new server", "pid", cmd.Process.Pid)
+
+	// The new process is using our unix sockets now, so don't
+	// delete them when we close our copies
+	for _, ln := range s.sockets {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		if err := cmd.Wait(); err != nil {
+			s.log.Error("New server exited", "pid", cmd.Process.Pid, "err", err)
+		}
+	}()
+	return exited, nil
+}
+
+// handoffComplete tells the parent that handed over its sockets,
+// if any, that we're serving and it can shut down
+func (s *Server) handoffComplete() {
+	if ppid := handoffParent(); ppid != 0 {
+		os.Unsetenv(handoffEnv)
+		s.log.Info("Serving, telling old server to shut down", "pid", ppid)
+		syscall.Kill(ppid, syscall.SIGTERM)
+	}
+}
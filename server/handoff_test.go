@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSameAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		actual net.Addr
+		same   bool
+	}{
+		{":443", &net.TCPAddr{IP: net.IPv6unspecified, Port: 443}, true},
+		{":443", &net.TCPAddr{IP: net.IPv4zero, Port: 443}, true},
+		{":443", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}, false},
+		{":443", &net.TCPAddr{IP: net.IPv6unspecified, Port: 8443}, false},
+		{"127.0.0.1:80", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}, true},
+		{"[::1]:80", &net.TCPAddr{IP: net.IPv6loopback, Port: 80}, true},
+		{"127.0.0.1:80", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}, false},
+		{"unix:/run/mm.sock", &net.UnixAddr{Net: "unix", Name: "/run/mm.sock"}, true},
+		{"unix:/run/mm.sock", &net.UnixAddr{Net: "unix", Name: "/run/other.sock"}, false},
+		{":80", &net.UnixAddr{Net: "unix", Name: ":80"}, false},
+	}
+
+	for _, tc := range tests {
+		if got := sameAddr(tc.addr, tc.actual); got != tc.same {
+			t.Errorf("sameAddr(%q, %s): expected %v, got %v", tc.addr, tc.actual, tc.same, got)
+		}
+	}
+}
+
+func TestTakeInherited(t *testing.T) {
+	a, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	pool := []inherited{
+		{name: "web", ln: a},
+		{name: "unix:/run/mm.sock", ln: b},
+	}
+
+	ln, pool := takeInherited(pool, "unix:/run/mm.sock")
+	if ln != b || len(pool) != 1 {
+		t.Errorf("Expected to match by name, got %v, %d left", ln, len(pool))
+	}
+
+	ln, pool = takeInherited(pool, "127.0.0.1:1")
+	if ln != nil || len(pool) != 1 {
+		t.Errorf("Expected no match, got %v", ln)
+	}
+
+	ln, pool = takeInherited(pool, a.Addr().String())
+	if ln != a || len(pool) != 0 {
+		t.Errorf("Expected to match by address, got %v, %d left", ln, len(pool))
+	}
+}
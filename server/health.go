@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// Commit and BuildTime describe the build, for /version. Set them with
+// -ldflags "-X github.com/moosemorals/mm/server.Commit=...". If they
+// aren't set, the version control details Go stamps into the binary
+// are used instead
+var (
+	Commit    string
+	BuildTime string
+)
+
+// Server states, for readiness
+const (
+	stateStarting = iota
+	stateServing
+	stateDraining
+)
+
+type readyCheck struct {
+	name  string
+	check func() error
+}
+
+// AddReadyCheck adds a check to /readyz. The server isn't ready while
+// check returns an error
+func (s *Server) AddReadyCheck(name string, check func() error) {
+	s.readyChecks = append(s.readyChecks, readyCheck{name, check})
+}
+
+// setState records where the server is in its life
+func (s *Server) setState(state int32) {
+	atomic.StoreInt32(&s.state, state)
+}
+
+// ready gives the result of each check, and whether they all passed
+func (s *Server) ready() ([]string, bool) {
+	ok := true
+	var lines []string
+	report := func(name string, err error) {
+		if err != nil {
+			ok = false
+			lines = append(lines, fmt.Sprintf("%s: %v", name, err))
+		} else {
+			lines = append(lines, name+": ok")
+		}
+	}
+
+	switch atomic.LoadInt32(&s.state) {
+	case stateStarting:
+		report("listeners", errors.New("Not bound yet"))
+	case stateDraining:
+		report("listeners", errors.New("Shutting down"))
+	default:
+		report("listeners", nil)
+	}
+	for _, c := range s.readyChecks {
+		report(c.name, c.check())
+	}
+	return lines, ok
+}
+
+// handleHealth answers /healthz. If it can answer, the process is alive
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReady answers /readyz, with 503 if the server shouldn't get traffic
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	lines, ok := s.ready()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+}
+
+// Version describes the build
+type Version struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+	GoVersion string `json:"goVersion"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+// GetVersion gives details of the running build
+func GetVersion() Version {
+	v := Version{
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if v.Commit == "" {
+					v.Commit = setting.Value
+				}
+			case "vcs.time":
+				if v.BuildTime == "" {
+					v.BuildTime = setting.Value
+				}
+			case "vcs.modified":
+				v.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return v
+}
+
+// handleVersion answers /version
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetVersion())
+}
+
+// handleStatus adds the health, readiness and version endpoints to mux
+func (s *Server) handleStatus(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+	mux.HandleFunc("/version", s.handleVersion)
+}
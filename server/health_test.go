@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestReady(t *testing.T) {
+	s, err := Create(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checkErr error
+	s.AddReadyCheck("data", func() error { return checkErr })
+
+	get := func() (int, string) {
+		w := httptest.NewRecorder()
+		s.admin.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w.Code, w.Body.String()
+	}
+
+	if code, body := get(); code != http.StatusServiceUnavailable || !strings.Contains(body, "listeners: Not bound yet") {
+		t.Errorf("Should not be ready before binding, got %d %q", code, body)
+	}
+
+	s.setState(stateServing)
+	if code, body := get(); code != http.StatusOK || body != "listeners: ok\ndata: ok\n" {
+		t.Errorf("Should be ready, got %d %q", code, body)
+	}
+
+	checkErr = errors.New("Not loaded")
+	if code, body := get(); code != http.StatusServiceUnavailable || !strings.Contains(body, "data: Not loaded") {
+		t.Errorf("Should fail the check, got %d %q", code, body)
+	}
+
+	checkErr = nil
+	s.setState(stateDraining)
+	if code, _ := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("Should not be ready while draining, got %d", code)
+	}
+}
+
+func TestHealthAndVersion(t *testing.T) {
+	s, err := Create(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.admin.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("Unexpected health response %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.admin.ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	var v Version
+	if err := json.NewDecoder(w.Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.GoVersion != runtime.Version() {
+		t.Errorf("Expected Go version %s, got %+v", runtime.Version(), v)
+	}
+}
+
+func TestStatusOnlyOnAdmin(t *testing.T) {
+	var opts Options
+	if err := opts.AddAdmin("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.AddVirtualHost(VirtualHost{Host: "eve.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Handle("/", http.NotFoundHandler())
+	s.HandleHost("eve.example.com", "/", http.NotFoundHandler())
+
+	for _, host := range []string{"example.com", "eve.example.com"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/healthz", nil)
+		r.Host = host
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s shouldn't serve /healthz with an admin listener, got %d", host, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.admin.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Admin should serve /healthz, got %d", w.Code)
+	}
+}
+
+func TestPublicStatus(t *testing.T) {
+	get := func(s *Server, path string) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	s, err := Create(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Handle("/", http.NotFoundHandler())
+	if code := get(s, "/healthz"); code != http.StatusOK {
+		t.Errorf("Site should serve /healthz without an admin listener, got %d", code)
+	}
+	for _, p := range []string{"/readyz", "/version"} {
+		if code := get(s, p); code != http.StatusNotFound {
+			t.Errorf("Site shouldn't serve %s unless asked, got %d", p, code)
+		}
+	}
+
+	var opts Options
+	opts.SetPublicStatus()
+	if s, err = Create(opts); err != nil {
+		t.Fatal(err)
+	}
+	for p, expected := range map[string]int{"/healthz": http.StatusOK, "/readyz": http.StatusServiceUnavailable, "/version": http.StatusOK} {
+		if code := get(s, p); code != expected {
+			t.Errorf("%s: expected %d, got %d", p, expected, code)
+		}
+	}
+}
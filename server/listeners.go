@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// Listener kinds
+const (
+	// listenRedirect is plain http that redirects to https
+	listenRedirect = "redirect"
+	// listenHTTP is plain http that serves the site
+	listenHTTP = "http"
+	// listenHTTPS is https that serves the site
+	listenHTTPS = "https"
+	// listenAdmin is plain http that serves metrics, not the site
+	listenAdmin = "admin"
+)
+
+// Addresses starting with this are unix domain sockets
+const unixPrefix = "unix:"
+
+type listener struct {
+	kind string
+	addr string
+	// For redirect listeners, the https address to redirect to
+	redirectTo string
+	// Expect PROXY protocol headers from trusted proxies
+	proxyProtocol bool
+	// Most connections open at once, zero for no limit
+	maxConns int
+}
+
+// splitNetwork works out the network for addr, and strips any prefix
+func splitNetwork(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixPrefix)
+	}
+	return "tcp", addr
+}
+
+// checkAddr makes sure addr looks like host:port or unix:/path
+func checkAddr(addr string) error {
+	network, address := splitNetwork(addr)
+	if network == "unix" {
+		if address == "" {
+			return errors.New("Missing socket path")
+		}
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("Bad port %q", port)
+	}
+	return nil
+}
+
+// listen opens a listener for addr. Stale unix sockets
+// left over from a previous run are removed first
+func listen(addr string) (net.Listener, error) {
+	network, address := splitNetwork(addr)
+	if network == "unix" {
+		if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// redirectPort gives the port part of an https address, or an
+// empty string if redirects should go to the default port
+func redirectPort(httpsAddr string) string {
+	network, address := splitNetwork(httpsAddr)
+	if network != "tcp" {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil || port == "443" {
+		return ""
+	}
+	return port
+}
+
+// wrapListener adds connection limits and PROXY protocol support to
+// ln, if server needs them
+func (s *Server) wrapListener(server *http.Server, ln net.Listener) net.Listener {
+	l := s.serverListeners[server]
+	if l.maxConns > 0 {
+		ln = newLimitListener(ln, l.maxConns)
+	}
+	if l.proxyProtocol {
+		ln = &proxyproto.Listener{Listener: ln, Policy: s.proxyPolicy}
+	}
+	return ln
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// logger is used by the parts of the package that can be used without
+// a Server, like Static and Recover. A Server logs to its own logger
+var logger = slog.Default()
+
+// SetLogger sets the logger used by the parts of the server package
+// that aren't tied to a Server. Each Server uses the "server" logger
+// from its Options
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// Logging picks how logs are written
+type Logging struct {
+	// JSON logs one JSON object per line, instead of key=value text
+	JSON bool
+	// Level is the minimum level logged
+	Level slog.Level
+	// Levels overrides Level for named loggers
+	Levels map[string]slog.Level
+}
+
+// Logger names that can have their own level. "access" is the request
+// log, and the others are the packages that make up the site
+var loggerNames = []string{"main", "server", "access", "eveapi", "linkshare", "articles"}
+
+// Logger returns a logger for name, with its own level. The access
+// logger writes to stdout, everything else goes to stderr
+func (o *Options) Logger(name string) *slog.Logger {
+	var w io.Writer = os.Stderr
+	if name == "access" {
+		w = os.Stdout
+	}
+
+	level := o.logging.Level
+	if l, ok := o.logging.Levels[name]; ok {
+		level = l
+	}
+	ho := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	if o.logging.JSON {
+		h = slog.NewJSONHandler(w, ho)
+	} else {
+		h = slog.NewTextHandler(w, ho)
+	}
+	return slog.New(h).With("log", name)
+}
+
+// AddLogFields adds fields to every line of the access log. f is called
+// after the request has been handled, and can return nil
+func (s *Server) AddLogFields(f func(r *http.Request) []slog.Attr) {
+	s.logFields = append(s.logFields, f)
+}
+
+// logRequests writes a line to the access log for each request
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		status := sw.status
+		if sw.hijacked {
+			status = http.StatusSwitchingProtocols
+		} else if status == 0 {
+			status = http.StatusOK
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("host", r.Host),
+			slog.String("path", r.URL.RequestURI()),
+			slog.String("proto", r.Proto),
+			slog.Int("status", status),
+			slog.Int64("bytes", sw.written),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("remote", r.RemoteAddr),
+			slog.String("referer", r.Referer()),
+			slog.String("user_agent", r.UserAgent()),
+		}
+		if id := w.Header().Get(requestIDHeader); id != "" {
+			attrs = append(attrs, slog.String("request_id", id))
+		}
+		if r.TLS != nil {
+			attrs = append(attrs, slog.String("tls", tls.VersionName(r.TLS.Version)))
+		}
+		for _, f := range s.logFields {
+			attrs = append(attrs, f(r)...)
+		}
+
+		s.accessLog.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
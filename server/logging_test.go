@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLogRequests(t *testing.T) {
+	var buf bytes.Buffer
+	s, err := Create(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.accessLog = slog.New(slog.NewJSONHandler(&buf, nil))
+	s.AddLogFields(func(r *http.Request) []slog.Attr {
+		return []slog.Attr{slog.String("character", "Someone")}
+	})
+
+	h := s.logRequests(RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	})))
+
+	r := httptest.NewRequest("GET", "https://example.com/pot?x=1", nil)
+	r.TLS = &tls.ConnectionState{Version: tls.VersionTLS13}
+	r.Header.Set("X-Request-ID", "req-1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Can't parse log line %q: %v", buf.String(), err)
+	}
+
+	expected := map[string]interface{}{
+		"msg":        "request",
+		"method":     "GET",
+		"path":       "/pot?x=1",
+		"status":     float64(http.StatusTeapot),
+		"bytes":      float64(len("short and stout")),
+		"request_id": "req-1",
+		"tls":        "TLS 1.3",
+		"character":  "Someone",
+	}
+	for k, v := range expected {
+		if line[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, line[k])
+		}
+	}
+	if _, ok := line["latency"]; !ok {
+		t.Error("Missing latency")
+	}
+}
+
+func TestServerLoggers(t *testing.T) {
+	before := logger
+	var buf bytes.Buffer
+	first, err := Create(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.log = slog.New(slog.NewTextHandler(&buf, nil))
+	if _, err := Create(Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if logger != before {
+		t.Error("Create shouldn't replace the package logger")
+	}
+
+	first.AddShutdownHook("broken", func(ctx context.Context) error {
+		return errors.New("broken")
+	})
+	first.runHooks(hookDrained)
+	if !bytes.Contains(buf.Bytes(), []byte("Shutdown hook failed")) {
+		t.Errorf("Expected the first server to log to its own logger, got %q", buf.String())
+	}
+}
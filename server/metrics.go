@@ -0,0 +1,226 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are served in the Prometheus text format, which is simple
+// enough to write by hand. Other packages add their own metrics with
+// AddMetrics
+
+// Upper bounds of the request latency buckets, in seconds
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Methods counted by name. Anything else is counted as "other", so
+// clients can't make up new label values
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true,
+}
+
+type requestKey struct {
+	route  string
+	method string
+	status int
+}
+
+// histogram counts observations into latencyBuckets
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(latencyBuckets))
+	}
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// write writes h with the given labels, which can be empty
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var n uint64
+	for i, b := range latencyBuckets {
+		if h.buckets != nil {
+			n += h.buckets[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, b, n)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// requestMetrics counts requests to the site
+type requestMetrics struct {
+	mu       sync.Mutex
+	started  time.Time
+	inFlight int
+	requests map[requestKey]uint64
+	latency  map[string]*histogram
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{
+		started:  time.Now(),
+		requests: make(map[requestKey]uint64),
+		latency:  make(map[string]*histogram),
+	}
+}
+
+func (m *requestMetrics) add(n int) {
+	m.mu.Lock()
+	m.inFlight += n
+	m.mu.Unlock()
+}
+
+func (m *requestMetrics) observe(route, method string, status int, d time.Duration) {
+	if !knownMethods[method] {
+		method = "other"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{route, method, status}]++
+	h, ok := m.latency[route]
+	if !ok {
+		h = &histogram{}
+		m.latency[route] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *requestMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+
+	writeHeader(w, "http_requests_total", "counter", "Requests to the site, by route, method and status")
+	for _, k := range keys {
+		fmt.Fprintf(w, "http_requests_total{route=%s,method=%s,status=\"%d\"} %d\n",
+			quoteLabel(k.route), quoteLabel(k.method), k.status, m.requests[k])
+	}
+
+	routes := make([]string, 0, len(m.latency))
+	for r := range m.latency {
+		routes = append(routes, r)
+	}
+	sort.Strings(routes)
+
+	writeHeader(w, "http_request_duration_seconds", "histogram", "Time taken to handle requests, by route")
+	for _, r := range routes {
+		m.latency[r].write(w, "http_request_duration_seconds", "route="+quoteLabel(r))
+	}
+
+	writeHeader(w, "http_requests_in_flight", "gauge", "Requests being handled right now")
+	fmt.Fprintf(w, "http_requests_in_flight %d\n", m.inFlight)
+
+	writeHeader(w, "process_start_time_seconds", "gauge", "When the server started, in seconds since the epoch")
+	fmt.Fprintf(w, "process_start_time_seconds %d\n", m.started.Unix())
+
+	writeHeader(w, "go_goroutines", "gauge", "Number of goroutines")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel quotes a label value
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+// AddMetrics adds metrics from outside the server package. f is called
+// each time the metrics are fetched, and should write them in the
+// Prometheus text format
+func (s *Server) AddMetrics(f func(w io.Writer)) {
+	s.collectors = append(s.collectors, f)
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format. It
+// is served from /metrics on admin listeners, and can be mounted on
+// the site as well
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		s.metrics.write(w)
+		for _, f := range s.collectors {
+			f(w)
+		}
+	})
+}
+
+// route gives the pattern that the site's mux would use for r,
+// starting with the virtual host if there is one, or "none" if
+// nothing matches
+func (s *Server) route(r *http.Request) string {
+	mux, host := s.router.mux(r)
+	if mux == nil {
+		return host + " redirect"
+	}
+	if _, pattern := mux.Handler(r); pattern != "" {
+		return host + pattern
+	}
+	return "none"
+}
+
+// countRequests records metrics for each request to the site
+func (s *Server) countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := s.route(r)
+		s.metrics.add(1)
+		defer s.metrics.add(-1)
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		status := sw.status
+		if sw.hijacked {
+			status = http.StatusSwitchingProtocols
+		} else if status == 0 {
+			status = http.StatusOK
+		}
+		s.metrics.observe(route, r.Method, status, time.Since(start))
+	})
+}
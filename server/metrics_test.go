@@ -0,0 +1,53 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	s, err := Create(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Handle("/pot/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	s.AddMetrics(func(w io.Writer) {
+		io.WriteString(w, "extra_total 3\n")
+	})
+
+	h := s.countRequests(s)
+	for _, path := range []string{"/pot/1", "/pot/2", "/missing"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/pot/3", nil))
+
+	w := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	expected := []string{
+		`http_requests_total{route="/pot/",method="GET",status="418"} 2`,
+		`http_requests_total{route="/pot/",method="other",status="418"} 1`,
+		`http_requests_total{route="none",method="GET",status="404"} 1`,
+		`http_request_duration_seconds_count{route="/pot/"} 3`,
+		`http_request_duration_seconds_bucket{route="/pot/",le="+Inf"} 3`,
+		`http_requests_in_flight 0`,
+		`extra_total 3`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e+"\n") {
+			t.Errorf("Missing %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestQuoteLabel(t *testing.T) {
+	if q := quoteLabel("a\"b\\c\n"); q != `"a\"b\\c\n"` {
+		t.Errorf("Got %s", q)
+	}
+}
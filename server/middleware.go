@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+)
+
+// Middleware wraps a handler with another handler
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps h in middleware, so that the first one runs first
+func chain(h http.Handler, mw ...Middleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Use adds middleware that runs on every request to the site, in the
+// order it was added
+func (s *Server) Use(mw ...Middleware) {
+	s.middleware = append(s.middleware, mw...)
+	s.handler = chain(s.router, s.middleware...)
+}
+
+// SetErrorPage sets the page sent by the built in Recover middleware
+// when a handler panics. It should send a 500 status
+func (s *Server) SetErrorPage(h http.Handler) {
+	s.errorPage = h
+}
+
+// serveErrorPage sends the page set with SetErrorPage, or a plain one
+func (s *Server) serveErrorPage(w http.ResponseWriter, r *http.Request) {
+	if s.errorPage == nil {
+		serveDefaultErrorPage(w, r)
+		return
+	}
+	s.errorPage.ServeHTTP(w, r)
+}
+
+// ServeHTTP sends requests through the middleware to the handlers
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Builtins picks the built in middleware that Create adds to the server
+type Builtins struct {
+	RequestID bool
+	Recover   bool
+	Compress  bool
+	// Security headers are added if any are set
+	Security SecurityHeaders
+}
+
+// middleware gives the middleware to use, in order. errorPage is
+// passed to Recover
+func (b Builtins) middleware(errorPage http.Handler, log *slog.Logger) []Middleware {
+	var mw []Middleware
+	if b.RequestID {
+		mw = append(mw, RequestID)
+	}
+	if b.Recover {
+		mw = append(mw, recoverTo(errorPage, log))
+	}
+	if b.Security != (SecurityHeaders{}) {
+		mw = append(mw, Secure(b.Security))
+	}
+	if b.Compress {
+		mw = append(mw, Compress)
+	}
+	return mw
+}
+
+type contextKey string
+
+const requestIDKey = contextKey("requestID")
+
+const requestIDHeader = "X-Request-ID"
+
+// Incoming request IDs are only used if they look like this
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID gives each request an ID, reusing the X-Request-ID header
+// from the client (or proxy) if there is a sensible one. The ID is sent
+// back in the response headers, and can be found with GetRequestID
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// GetRequestID returns the ID given to r by the RequestID middleware,
+// or an empty string
+func GetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+const defaultErrorPage = `<!DOCTYPE html>
+<html><head><title>Server error</title></head>
+<body><h1>Server error</h1><p>Something went wrong. Please try again later.</p></body></html>
+`
+
+func serveDefaultErrorPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(defaultErrorPage))
+}
+
+// Recover catches panics from handlers, logs them, and sends a 500
+// response. errorPage is used for the response, if it isn't nil
+func Recover(errorPage http.Handler) Middleware {
+	return recoverTo(errorPage, nil)
+}
+
+// recoverTo is Recover, logging panics to log, or the package logger
+// if log is nil
+func recoverTo(errorPage http.Handler, log *slog.Logger) Middleware {
+	if errorPage == nil {
+		errorPage = http.HandlerFunc(serveDefaultErrorPage)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw := &statusWriter{ResponseWriter: w}
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if err == http.ErrAbortHandler {
+					// Let net/http deal with this one quietly
+					panic(err)
+				}
+
+				l := log
+				if l == nil {
+					l = logger
+				}
+				l.Error("Panic serving request", "method", r.Method, "path", r.URL.RequestURI(), "request_id", GetRequestID(r), "err", err, "stack", string(debug.Stack()))
+				if sw.status != 0 || sw.hijacked {
+					// Too late to send an error page
+					return
+				}
+				w.Header().Del("Content-Encoding")
+				w.Header().Del("Content-Length")
+				errorPage.ServeHTTP(w, r)
+			}()
+			next.ServeHTTP(sw, r)
+		})
+	}
+}
+
+// statusWriter remembers the response status
+type statusWriter struct {
+	http.ResponseWriter
+	status   int
+	written  int64
+	hijacked bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijack not supported")
+	}
+	w.hijacked = true
+	return h.Hijack()
+}
+
+// SecurityHeaders are sent with every response by the Secure middleware.
+// Empty fields aren't sent. Strict-Transport-Security is set with
+// Options.SetHSTS, not here
+type SecurityHeaders struct {
+	// ContentSecurityPolicy is the Content-Security-Policy header
+	ContentSecurityPolicy string
+	// ReferrerPolicy is the Referrer-Policy header
+	ReferrerPolicy string
+	// NoSniff sends X-Content-Type-Options: nosniff
+	NoSniff bool
+}
+
+// Secure adds security headers to responses
+func Secure(h SecurityHeaders) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := w.Header()
+			if h.ContentSecurityPolicy != "" {
+				header.Set("Content-Security-Policy", h.ContentSecurityPolicy)
+			}
+			if h.ReferrerPolicy != "" {
+				header.Set("Referrer-Policy", h.ReferrerPolicy)
+			}
+			if h.NoSniff {
+				header.Set("X-Content-Type-Options", "nosniff")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
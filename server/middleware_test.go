@@ -0,0 +1,175 @@
+package server
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestUseOrder(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	s, err := Create(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Use(mark("a"), mark("b"))
+	s.Use(mark("c"))
+	s.Handle("/x", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), mark("route"))
+
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+
+	if got := strings.Join(order, ","); got != "a,b,c,route,handler" {
+		t.Errorf("Unexpected order %s", got)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = GetRequestID(r)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if seen == "" || w.Header().Get("X-Request-ID") != seen {
+		t.Errorf("Expected a generated ID, got %q and %q", seen, w.Header().Get("X-Request-ID"))
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Request-ID", "abc-123")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if seen != "abc-123" {
+		t.Errorf("Expected the incoming ID, got %q", seen)
+	}
+
+	r.Header.Set("X-Request-ID", "<script>")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if seen == "<script>" {
+		t.Error("Bad incoming IDs should be replaced")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	h := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		panic("oops")
+	}), Recover(nil), Compress)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "Server error") {
+		t.Errorf("Expected the error page, got %q", w.Body.String())
+	}
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat("Hello, world. ", 100)
+	h := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(body))
+	}))
+
+	tests := []struct {
+		accept   string
+		encoding string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0, gzip", "gzip"},
+		{"identity", ""},
+	}
+
+	for _, tc := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tc.accept)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if enc := w.Header().Get("Content-Encoding"); enc != tc.encoding {
+			t.Errorf("%q: expected encoding %q, got %q", tc.accept, tc.encoding, enc)
+			continue
+		}
+
+		var got []byte
+		var err error
+		switch tc.encoding {
+		case "gzip":
+			var zr *gzip.Reader
+			if zr, err = gzip.NewReader(w.Body); err == nil {
+				got, err = ioutil.ReadAll(zr)
+			}
+		case "br":
+			got, err = ioutil.ReadAll(brotli.NewReader(w.Body))
+		default:
+			got = w.Body.Bytes()
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.accept, err)
+		} else if string(got) != body {
+			t.Errorf("%q: body didn't survive compression", tc.accept)
+		}
+	}
+}
+
+func TestCompressSkipsImages(t *testing.T) {
+	h := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("not really a png"))
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Images shouldn't be compressed, got %q", enc)
+	}
+	if w.Body.String() != "not really a png" {
+		t.Errorf("Body changed: %q", w.Body.String())
+	}
+}
+
+func TestSecure(t *testing.T) {
+	h := Secure(SecurityHeaders{
+		ContentSecurityPolicy: "default-src 'self'",
+		ReferrerPolicy:        "same-origin",
+		NoSniff:               true,
+	})(http.NotFoundHandler())
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "https://example.com/", nil))
+	expected := map[string]string{
+		"Content-Security-Policy": "default-src 'self'",
+		"Referrer-Policy":         "same-origin",
+		"X-Content-Type-Options":  "nosniff",
+	}
+	for k, v := range expected {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("%s: expected %q, got %q", k, v, got)
+		}
+	}
+}
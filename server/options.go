@@ -1,21 +1,363 @@
 package server
 
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLS modes
+const (
+	// TLSAutocert fetches certificates from Let's Encrypt
+	TLSAutocert = "autocert"
+	// TLSDebug uses cert.pem and key.pem from the working directory
+	TLSDebug = "debug"
+	// TLSFiles uses certificate files added with AddCertFile
+	TLSFiles = "files"
+)
+
+// Timeouts are applied to each http.Server
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	Idle  time.Duration
+}
+
+var defaultTimeouts = Timeouts{
+	Read:  15 * time.Second,
+	Write: 60 * time.Second,
+	Idle:  120 * time.Second,
+}
+
+var defaultRedirectTimeouts = Timeouts{
+	Read:  5 * time.Second,
+	Write: 5 * time.Second,
+}
+
+var defaultHosts = []string{"moosemorals.com", "www.moosemorals.com"}
+
+const defaultCertCache = "tls"
+
+var defaultMounts = map[string]string{
+	"static":   "/",
+	"eveapi":   "/eveapi/",
+	"articles": "/articles/",
+}
+
 // Options holds server options
 type Options struct {
-	debug bool
+	debug   bool
+	tlsMode string
+
+	hosts      []string
+	hostPolicy autocert.HostPolicy
+
+	certCache     string
+	acmeEmail     string
+	acmeDirectory string
+	acmeRoots     *x509.CertPool
+
+	certFiles []CertFile
+
+	redirectStatus int
+	hsts           HSTS
+	publicStatus   bool
+
+	builtins Builtins
+
+	logging Logging
+
+	listeners []listener
+
+	trustedProxies []*net.IPNet
+	trustUnix      bool
+
+	rateLimits []RateLimit
 
-	httpAddr  []string
-	httpsAddr []string
+	timeouts         Timeouts
+	redirectTimeouts Timeouts
+	shutdownTimeouts ShutdownTimeouts
+
+	mounts  map[string]string
+	vhosts  []VirtualHost
+	proxies []Proxy
 }
 
 // SetDebug enables the debug option on the server.
 func (o *Options) SetDebug() {
 	o.debug = true
+	o.tlsMode = TLSDebug
+}
+
+// SetTLSMode picks where certificates come from
+func (o *Options) SetTLSMode(mode string) {
+	o.tlsMode = mode
 }
 
 // AddAddr adds a pair of http/https addresses.
-// The http address is only used to redirect to https
-func (o *Options) AddAddr(http, https string) {
-	o.httpAddr = append(o.httpAddr, http)
-	o.httpsAddr = append(o.httpsAddr, https)
+// The http address is only used to redirect to https. Either
+// address can be empty, but not both
+func (o *Options) AddAddr(http, https string) error {
+	if http == "" && https == "" {
+		return errors.New("Need at least one of http or https")
+	}
+	if http != "" {
+		if err := checkAddr(http); err != nil {
+			return fmt.Errorf("http: %v", err)
+		}
+	}
+	if https != "" {
+		if err := checkAddr(https); err != nil {
+			return fmt.Errorf("https: %v", err)
+		}
+	}
+
+	if http != "" {
+		o.listeners = append(o.listeners, listener{kind: listenRedirect, addr: http, redirectTo: https})
+	}
+	if https != "" {
+		o.listeners = append(o.listeners, listener{kind: listenHTTPS, addr: https})
+	}
+	return nil
+}
+
+// AddHTTP adds a plain http address that serves the site directly,
+// for use behind a proxy that deals with TLS.
+// Addresses starting "unix:" are unix domain sockets
+func (o *Options) AddHTTP(addr string) error {
+	if err := checkAddr(addr); err != nil {
+		return err
+	}
+	o.listeners = append(o.listeners, listener{kind: listenHTTP, addr: addr})
+	return nil
+}
+
+// AddHTTPS adds an https address without a redirect partner.
+// Addresses starting "unix:" are unix domain sockets
+func (o *Options) AddHTTPS(addr string) error {
+	if err := checkAddr(addr); err != nil {
+		return err
+	}
+	o.listeners = append(o.listeners, listener{kind: listenHTTPS, addr: addr})
+	return nil
+}
+
+// AddAdmin adds a plain http address that serves /metrics instead of
+// the site. It should only be reachable from trusted networks.
+// Addresses starting "unix:" are unix domain sockets
+func (o *Options) AddAdmin(addr string) error {
+	if err := checkAddr(addr); err != nil {
+		return err
+	}
+	o.listeners = append(o.listeners, listener{kind: listenAdmin, addr: addr})
+	return nil
+}
+
+// AddHost adds a hostname that the server will get certificates for
+func (o *Options) AddHost(host string) {
+	o.hosts = append(o.hosts, host)
+}
+
+// SetHostPolicy replaces the hostname whitelist with a custom policy
+// for deciding which names autocert will get certificates for
+func (o *Options) SetHostPolicy(p autocert.HostPolicy) {
+	o.hostPolicy = p
+}
+
+// SetCertCache sets the directory that autocert keeps its account key
+// and certificates in
+func (o *Options) SetCertCache(dir string) {
+	o.certCache = dir
+}
+
+// SetACMEEmail sets the contact address given to the certificate authority
+func (o *Options) SetACMEEmail(email string) {
+	o.acmeEmail = email
+}
+
+// SetACMEDirectory points autocert at a different ACME server, for example
+// a staging or test server. If roots is not nil, it is used to verify the
+// ACME server's certificate
+func (o *Options) SetACMEDirectory(url string, roots *x509.CertPool) {
+	o.acmeDirectory = url
+	o.acmeRoots = roots
+}
+
+// AddCertFile adds a certificate and key for the files TLS mode. Add
+// one pair for each certificate, the right one is picked using SNI
+func (o *Options) AddCertFile(cert, key string) {
+	o.certFiles = append(o.certFiles, CertFile{Cert: cert, Key: key})
+}
+
+// SetRedirectStatus sets the status code used to redirect http
+// to https. It must be 301, 302, 307 or 308
+func (o *Options) SetRedirectStatus(status int) error {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		o.redirectStatus = status
+		return nil
+	}
+	return fmt.Errorf("%d isn't a redirect status", status)
+}
+
+// SetPublicStatus serves /readyz and /version on the site as well as on
+// admin listeners. Without it the site only has /healthz, and only if
+// there isn't an admin listener
+func (o *Options) SetPublicStatus() {
+	o.publicStatus = true
+}
+
+// SetHSTS sets the Strict-Transport-Security policy for https responses
+func (o *Options) SetHSTS(h HSTS) {
+	o.hsts = h
+}
+
+// SetBuiltins picks which built in middleware is used
+func (o *Options) SetBuiltins(b Builtins) {
+	o.builtins = b
+}
+
+// SetLogging picks how logs are written
+func (o *Options) SetLogging(l Logging) {
+	o.logging = l
+}
+
+// SetTimeouts sets the timeouts for https servers. Zero fields
+// keep their defaults
+func (o *Options) SetTimeouts(t Timeouts) {
+	o.timeouts = t
+}
+
+// SetRedirectTimeouts sets the timeouts for the http servers
+// that redirect to https. Zero fields keep their defaults
+func (o *Options) SetRedirectTimeouts(t Timeouts) {
+	o.redirectTimeouts = t
+}
+
+// SetShutdownTimeouts sets how long shutdown waits for connections
+// and hooks. Zero fields keep their defaults
+func (o *Options) SetShutdownTimeouts(t ShutdownTimeouts) {
+	o.shutdownTimeouts = t
+}
+
+// SetMount asks for the named handler to be mounted at path
+func (o *Options) SetMount(name, path string) {
+	if o.mounts == nil {
+		o.mounts = make(map[string]string)
+	}
+	o.mounts[name] = path
+}
+
+// Mounts returns the handlers that should be mounted, by name.
+// If none have been set, the default handlers are returned
+func (o *Options) Mounts() map[string]string {
+	src := o.mounts
+	if src == nil {
+		src = defaultMounts
+	}
+	m := make(map[string]string, len(src))
+	for k, v := range src {
+		m[k] = v
+	}
+	return m
+}
+
+func (o *Options) getTLSMode() string {
+	if o.tlsMode == "" {
+		return TLSAutocert
+	}
+	return o.tlsMode
+}
+
+func (o *Options) hasHTTPS() bool {
+	return o.hasListener(listenHTTPS)
+}
+
+func (o *Options) hasAdmin() bool {
+	return o.hasListener(listenAdmin)
+}
+
+func (o *Options) hasListener(kind string) bool {
+	for _, l := range o.listeners {
+		if l.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// getHosts gives the names to get certificates for, including
+// virtual hosts that aren't wildcards
+func (o *Options) getHosts() []string {
+	hosts := o.hosts
+	if len(hosts) == 0 {
+		hosts = defaultHosts
+	}
+	hosts = append([]string(nil), hosts...)
+
+next:
+	for _, v := range o.vhosts {
+		if strings.HasPrefix(v.Host, "*.") {
+			continue
+		}
+		for _, h := range hosts {
+			if strings.EqualFold(h, v.Host) {
+				continue next
+			}
+		}
+		hosts = append(hosts, v.Host)
+	}
+	return hosts
+}
+
+func (o *Options) getHostPolicy() autocert.HostPolicy {
+	if o.hostPolicy != nil {
+		return o.hostPolicy
+	}
+	return autocert.HostWhitelist(o.getHosts()...)
+}
+
+func (o *Options) getRedirectStatus() int {
+	if o.redirectStatus == 0 {
+		return http.StatusMovedPermanently
+	}
+	return o.redirectStatus
+}
+
+func (o *Options) getCertCache() string {
+	if o.certCache == "" {
+		return defaultCertCache
+	}
+	return o.certCache
+}
+
+func (o *Options) getShutdownTimeouts() ShutdownTimeouts {
+	t := o.shutdownTimeouts
+	if t.Drain == 0 {
+		t.Drain = defaultShutdownTimeouts.Drain
+	}
+	if t.Hook == 0 {
+		t.Hook = defaultShutdownTimeouts.Hook
+	}
+	return t
+}
+
+func (t Timeouts) orDefault(d Timeouts) Timeouts {
+	if t.Read == 0 {
+		t.Read = d.Read
+	}
+	if t.Write == 0 {
+		t.Write = d.Write
+	}
+	if t.Idle == 0 {
+		t.Idle = d.Idle
+	}
+	return t
 }
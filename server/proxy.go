@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Ways of picking an upstream
+const (
+	// BalanceRoundRobin takes each upstream in turn
+	BalanceRoundRobin = "round-robin"
+	// BalanceLeastConn picks the upstream with the fewest open requests
+	BalanceLeastConn = "least-connections"
+)
+
+const defaultHealthInterval = 10 * time.Second
+
+// Proxy passes requests under a path on to other servers
+type Proxy struct {
+	// Path is where the proxy is mounted, like /grafana/
+	Path string
+	// Host mounts the proxy on a virtual host, instead of the main site
+	Host string
+	// Upstreams are the base URLs of the backends, like http://127.0.0.1:3000
+	Upstreams []string
+	// StripPrefix removes Path from requests before they're passed on
+	StripPrefix bool
+	// Balance is BalanceRoundRobin (the default) or BalanceLeastConn
+	Balance string
+	// HealthCheck is a path fetched from each upstream every
+	// HealthInterval (default 10s). Upstreams that don't answer it
+	// with 2xx or 3xx aren't used until they do. Empty means no checks
+	HealthCheck    string
+	HealthInterval time.Duration
+}
+
+// check makes sure p makes sense, and fills in defaults
+func (p *Proxy) check() error {
+	if !strings.HasPrefix(p.Path, "/") {
+		return fmt.Errorf("Path %q must start with /", p.Path)
+	}
+	if p.Host != "" {
+		if err := checkHostPattern(strings.ToLower(p.Host)); err != nil {
+			return err
+		}
+	}
+	if len(p.Upstreams) == 0 {
+		return errors.New("Need at least one upstream")
+	}
+	for _, raw := range p.Upstreams {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("Upstream %q should be an absolute http(s) URL", raw)
+		}
+	}
+	switch p.Balance {
+	case "":
+		p.Balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConn:
+	default:
+		return fmt.Errorf("Unknown balance %q, expected %s or %s", p.Balance, BalanceRoundRobin, BalanceLeastConn)
+	}
+	if p.HealthCheck != "" && !strings.HasPrefix(p.HealthCheck, "/") {
+		return fmt.Errorf("Health check %q must start with /", p.HealthCheck)
+	}
+	if p.HealthInterval < 0 {
+		return errors.New("Health check interval can't be negative")
+	}
+	if p.HealthInterval == 0 {
+		p.HealthInterval = defaultHealthInterval
+	}
+	return nil
+}
+
+// AddProxy adds a reverse proxy, which is mounted when the server is created
+func (o *Options) AddProxy(p Proxy) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	p.Upstreams = append([]string(nil), p.Upstreams...)
+	o.proxies = append(o.proxies, p)
+	return nil
+}
+
+type upstream struct {
+	url   *url.URL
+	proxy *httputil.ReverseProxy
+	// open requests, for least-connections
+	active int64
+	// 1 if the upstream passed its last health check
+	healthy int32
+}
+
+// ProxyHandler is a reverse proxy to one or more upstreams
+type ProxyHandler struct {
+	spec      Proxy
+	upstreams []*upstream
+	next      uint64
+	client    *http.Client
+	log       *slog.Logger
+}
+
+// NewProxyHandler makes a reverse proxy. Health checks don't run until
+// Watch is called, which Server.HandleProxy does when the server starts
+func NewProxyHandler(p Proxy) (*ProxyHandler, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	h := &ProxyHandler{
+		spec:   p,
+		client: &http.Client{Transport: transport, Timeout: p.HealthInterval},
+		log:    logger,
+	}
+	prefix := strings.TrimSuffix(p.Path, "/")
+
+	for _, raw := range p.Upstreams {
+		u, _ := url.Parse(raw)
+		up := &upstream{url: u, healthy: 1}
+		up.proxy = &httputil.ReverseProxy{
+			Transport: transport,
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				if p.StripPrefix {
+					pr.Out.URL.Path = ensureSlash(strings.TrimPrefix(pr.Out.URL.Path, prefix))
+					pr.Out.URL.RawPath = ""
+					pr.Out.Header.Set("X-Forwarded-Prefix", prefix)
+				}
+				pr.SetXForwarded()
+				if f := getForwarded(pr.In); f != nil && f.chain != "" {
+					// Pass on the whole chain from a trusted proxy
+					pr.Out.Header.Set("X-Forwarded-For", f.chain)
+				}
+				pr.Out.Header.Set("X-Forwarded-Proto", Scheme(pr.In))
+				pr.SetURL(u)
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				h.log.Warn("Proxy error", "upstream", u.String(), "path", r.URL.RequestURI(), "err", err)
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		}
+		h.upstreams = append(h.upstreams, up)
+	}
+	return h, nil
+}
+
+func ensureSlash(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return "/" + p
+	}
+	return p
+}
+
+// pick chooses the upstream for a request, or nil if none are healthy
+func (h *ProxyHandler) pick() *upstream {
+	n := uint64(len(h.upstreams))
+	start := atomic.AddUint64(&h.next, 1) - 1
+
+	var best *upstream
+	for i := uint64(0); i < n; i++ {
+		u := h.upstreams[(start+i)%n]
+		if atomic.LoadInt32(&u.healthy) == 0 {
+			continue
+		}
+		if h.spec.Balance == BalanceRoundRobin {
+			return u
+		}
+		if best == nil || atomic.LoadInt64(&u.active) < atomic.LoadInt64(&best.active) {
+			best = u
+		}
+	}
+	return best
+}
+
+func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u := h.pick()
+	if u == nil {
+		http.Error(w, "No healthy upstream", http.StatusServiceUnavailable)
+		return
+	}
+
+	atomic.AddInt64(&u.active, 1)
+	defer atomic.AddInt64(&u.active, -1)
+	u.proxy.ServeHTTP(w, r)
+}
+
+// checkHealth fetches the health check path from each upstream
+func (h *ProxyHandler) checkHealth(ctx context.Context) {
+	for _, u := range h.upstreams {
+		target := *u.url
+		target.Path = strings.TrimSuffix(target.Path, "/") + h.spec.HealthCheck
+
+		healthy := int32(0)
+		req, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+		if err == nil {
+			var resp *http.Response
+			if resp, err = h.client.Do(req); err == nil {
+				resp.Body.Close()
+				if resp.StatusCode >= 200 && resp.StatusCode < 400 {
+					healthy = 1
+				} else {
+					err = fmt.Errorf("Got status %d", resp.StatusCode)
+				}
+			}
+		}
+
+		if atomic.SwapInt32(&u.healthy, healthy) != healthy {
+			if healthy == 1 {
+				h.log.Info("Upstream is healthy", "upstream", u.url.String())
+			} else {
+				h.log.Warn("Upstream is unhealthy", "upstream", u.url.String(), "err", err)
+			}
+		}
+	}
+}
+
+// Watch runs health checks until stop is closed. It does nothing if
+// the proxy doesn't have a health check
+func (h *ProxyHandler) Watch(stop <-chan struct{}) {
+	if h.spec.HealthCheck == "" {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(h.spec.HealthInterval)
+	defer ticker.Stop()
+	for {
+		h.checkHealth(ctx)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// HandleProxy mounts a reverse proxy on the site, or on p.Host. Health
+// checks run while the server is running
+func (s *Server) HandleProxy(p Proxy, mw ...Middleware) error {
+	h, err := NewProxyHandler(p)
+	if err != nil {
+		return err
+	}
+	h.log = s.log
+	if p.Host != "" {
+		s.HandleHost(p.Host, p.Path, h, mw...)
+	} else {
+		s.Handle(p.Path, h, mw...)
+	}
+	s.proxyHandlers = append(s.proxyHandlers, h)
+	return nil
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s|%s|%s", r.URL.RequestURI(), r.Header.Get("X-Forwarded-For"),
+			r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Forwarded-Prefix"))
+	}))
+	defer backend.Close()
+
+	h, err := NewProxyHandler(Proxy{Path: "/ci/", Upstreams: []string{backend.URL + "/base"}, StripPrefix: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(h http.Handler) string {
+		r := httptest.NewRequest("GET", "http://example.com/ci/job?x=1", nil)
+		r.RemoteAddr = "192.0.2.7:1234"
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+		r.Header.Set("X-Forwarded-Proto", "https")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	// Forwarded headers from untrusted clients are replaced
+	expected := "/base/job?x=1|192.0.2.7|example.com|http|/ci"
+	if got := get(h); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	// and from trusted proxies they're passed on
+	var opts Options
+	opts.AddTrustedProxy("192.0.2.0/24")
+	s, err := Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "/base/job?x=1|198.51.100.1, 192.0.2.7|example.com|https|/ci"
+	if got := get(s.trustProxies(h)); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestProxyBalance(t *testing.T) {
+	var backends []string
+	for i := 0; i < 3; i++ {
+		i := i
+		b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" && i == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, i)
+		}))
+		defer b.Close()
+		backends = append(backends, b.URL)
+	}
+
+	get := func(h http.Handler) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Body.String()
+	}
+
+	h, err := NewProxyHandler(Proxy{Path: "/", Upstreams: backends, HealthCheck: "/health"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, get(h))
+	}
+	if strings.Join(got, "") != "012" {
+		t.Errorf("Expected round robin, got %v", got)
+	}
+
+	// Upstream 1 fails its health check, and is skipped
+	h.checkHealth(context.Background())
+	got = nil
+	for i := 0; i < 4; i++ {
+		got = append(got, get(h))
+	}
+	if strings.Join(got, "") != "0220" {
+		t.Errorf("Expected 1 to be skipped, got %v", got)
+	}
+
+	h, err = NewProxyHandler(Proxy{Path: "/", Upstreams: backends, Balance: BalanceLeastConn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.upstreams[0].active = 3
+	h.upstreams[1].active = 1
+	h.upstreams[2].active = 2
+	for i := 0; i < 3; i++ {
+		if b := get(h); b != "1" {
+			t.Errorf("Expected least connections to pick 1, got %s", b)
+		}
+	}
+
+	for _, u := range h.upstreams {
+		u.healthy = 0
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with no healthy upstreams, got %d", w.Code)
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	// The backend echoes lines once the connection is upgraded
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "Expected upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		line, _ := rw.ReadString('\n')
+		rw.WriteString(line)
+		rw.Flush()
+	}))
+	defer backend.Close()
+
+	s, err := Create(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.HandleProxy(Proxy{Path: "/ws/", Upstreams: []string{backend.URL}}); err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(s)
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /ws/ HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %d", resp.StatusCode)
+	}
+	io.WriteString(conn, "hello\n")
+	if line, _ := br.ReadString('\n'); line != "hello\n" {
+		t.Errorf("Expected echo, got %q", line)
+	}
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What rate limits are counted by
+const (
+	// LimitByIP counts requests from each client address
+	LimitByIP = "ip"
+	// LimitByUser counts requests from each logged in user, as given by
+	// the function passed to Server.SetUserKey. Anonymous requests are
+	// counted by address
+	LimitByUser = "user"
+)
+
+// Idle buckets are thrown away this often
+const prunePeriod = time.Minute
+
+// RateLimit limits how often each client can make requests under a path
+type RateLimit struct {
+	// Path is a path prefix, like /eveapi/api. Only the limit with the
+	// longest matching prefix applies
+	Path string
+	// Rate is the number of requests allowed per second, on average
+	Rate float64
+	// Burst is how many requests can be made at once. Zero means
+	// the rate rounded up
+	Burst int
+	// By is LimitByIP (the default) or LimitByUser
+	By string
+}
+
+// AddRateLimit adds a rate limit. Each path can only have one
+func (o *Options) AddRateLimit(l RateLimit) error {
+	if !strings.HasPrefix(l.Path, "/") {
+		return fmt.Errorf("Path %q must start with /", l.Path)
+	}
+	if l.Rate <= 0 {
+		return errors.New("Rate must be more than zero")
+	}
+	if l.Burst < 0 {
+		return errors.New("Burst can't be negative")
+	}
+	if l.Burst == 0 {
+		l.Burst = int(math.Ceil(l.Rate))
+	}
+	switch l.By {
+	case "":
+		l.By = LimitByIP
+	case LimitByIP, LimitByUser:
+	default:
+		return fmt.Errorf("Unknown key %q, expected %s or %s", l.By, LimitByIP, LimitByUser)
+	}
+	for _, x := range o.rateLimits {
+		if x.Path == l.Path {
+			return fmt.Errorf("Path %q already has a limit", l.Path)
+		}
+	}
+	o.rateLimits = append(o.rateLimits, l)
+	return nil
+}
+
+// SetMaxConns limits the number of connections open at once to the
+// listeners for addr. Once the limit is reached, new connections wait
+// until an old one closes
+func (o *Options) SetMaxConns(addr string, n int) error {
+	if n < 0 {
+		return errors.New("Can't be negative")
+	}
+	found := false
+	for i := range o.listeners {
+		if o.listeners[i].addr == addr {
+			o.listeners[i].maxConns = n
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("No listener with that address")
+	}
+	return nil
+}
+
+// parseRate parses rates like "10/s", "30/m" or "100/h" into
+// requests per second
+func parseRate(raw string) (float64, error) {
+	parts := strings.SplitN(raw, "/", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Bad rate %q, expected something like 10/s", raw)
+	}
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Bad rate %q, expected a positive number of requests", raw)
+	}
+	switch parts[1] {
+	case "s":
+		return n, nil
+	case "m":
+		return n / 60, nil
+	case "h":
+		return n / 3600, nil
+	}
+	return 0, fmt.Errorf("Bad rate %q, expected s, m or h after the /", raw)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is a token bucket for each client
+type limiter struct {
+	RateLimit
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+func newLimiter(l RateLimit) *limiter {
+	return &limiter{
+		RateLimit: l,
+		buckets:   make(map[string]*bucket),
+		pruned:    time.Now(),
+	}
+}
+
+// allow takes a token from key's bucket. If there isn't one, it says
+// how long until there will be
+func (l *limiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.pruned) > prunePeriod {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// prune throws away buckets that have filled up again, since
+// they're the same as new ones
+func (l *limiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= float64(l.Burst) {
+			delete(l.buckets, k)
+		}
+	}
+	l.pruned = now
+}
+
+// SetUserKey sets the function used to tell users apart, for rate
+// limits that are counted by user. f returns an empty string for
+// anonymous requests
+func (s *Server) SetUserKey(f func(r *http.Request) string) {
+	s.userKey = f
+}
+
+// clientKey gives the key that l counts r by
+func (s *Server) clientKey(l *limiter, r *http.Request) string {
+	if l.By == LimitByUser && s.userKey != nil {
+		if k := s.userKey(r); k != "" {
+			return "user:" + k
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimit refuses requests with 429 once a client goes over the
+// limit for the path
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	if len(s.rateLimits) == 0 {
+		return next
+	}
+
+	var limiters []*limiter
+	for _, l := range s.rateLimits {
+		limiters = append(limiters, newLimiter(l))
+	}
+	sort.Slice(limiters, func(i, j int) bool {
+		return len(limiters[i].Path) > len(limiters[j].Path)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, l := range limiters {
+			if !strings.HasPrefix(r.URL.Path, l.Path) {
+				continue
+			}
+			ok, wait := l.allow(s.clientKey(l, r), time.Now())
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+			break
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitListener stops accepting connections while max are open
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(ln net.Listener, max int) *limitListener {
+	return &limitListener{
+		Listener: ln,
+		sem:      make(chan struct{}, max),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		raw  string
+		rate float64
+	}{
+		{"10/s", 10},
+		{"30/m", 0.5},
+		{"3600/h", 1},
+		{"0.5/s", 0.5},
+	}
+	for _, tc := range tests {
+		rate, err := parseRate(tc.raw)
+		if err != nil {
+			t.Errorf("%s: %v", tc.raw, err)
+		} else if rate != tc.rate {
+			t.Errorf("%s: expected %g, got %g", tc.raw, tc.rate, rate)
+		}
+	}
+
+	for _, raw := range []string{"", "10", "10/d", "x/s", "0/s", "-1/m"} {
+		if _, err := parseRate(raw); err == nil {
+			t.Errorf("%q: expected an error", raw)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(RateLimit{Path: "/", Rate: 2, Burst: 3})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("Request %d was refused", i)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok {
+		t.Fatal("Expected the fourth request to be refused")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms, got %v", wait)
+	}
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("Other clients shouldn't be limited")
+	}
+
+	if ok, _ := l.allow("a", now.Add(wait)); !ok {
+		t.Error("Expected a token after waiting")
+	}
+
+	l.allow("b", now.Add(2*prunePeriod))
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("Expected the idle bucket to be pruned")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := &Server{}
+	for _, l := range []RateLimit{
+		{Path: "/api/", Rate: 1, Burst: 1, By: LimitByUser},
+		{Path: "/api/slow", Rate: 1.0 / 60, Burst: 1},
+	} {
+		if err := s.AddRateLimit(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.SetUserKey(func(r *http.Request) string {
+		return r.Header.Get("X-User")
+	})
+	h := s.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	get := func(path, addr, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = addr
+		if user != "" {
+			r.Header.Set("X-User", user)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		path, addr, user string
+		status           int
+	}{
+		{"/other", "192.0.2.1:1000", "", 200},
+		{"/other", "192.0.2.1:1000", "", 200},
+		{"/api/a", "192.0.2.1:1000", "", 200},
+		{"/api/a", "192.0.2.1:1001", "", 429},
+		// Same address, but logged in
+		{"/api/a", "192.0.2.1:1000", "alice", 200},
+		{"/api/a", "192.0.2.2:1000", "alice", 429},
+		{"/api/a", "192.0.2.2:1000", "bob", 200},
+		// The longest prefix has its own limit
+		{"/api/slow", "192.0.2.1:1000", "", 200},
+		{"/api/slow", "192.0.2.1:1000", "", 429},
+	}
+	for i, tc := range tests {
+		w := get(tc.path, tc.addr, tc.user)
+		if w.Code != tc.status {
+			t.Errorf("%d: expected %d, got %d", i, tc.status, w.Code)
+		}
+	}
+
+	w := get("/api/slow", "192.0.2.1:1000", "")
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Expected Retry-After: 60, got %q", got)
+	}
+}
+
+func TestAddRateLimit(t *testing.T) {
+	var opts Options
+	if err := opts.AddRateLimit(RateLimit{Path: "/", Rate: 2.5}); err != nil {
+		t.Fatal(err)
+	}
+	if l := opts.rateLimits[0]; l.Burst != 3 || l.By != LimitByIP {
+		t.Errorf("Expected defaults, got %+v", l)
+	}
+
+	for _, l := range []RateLimit{
+		{Path: "api", Rate: 1},
+		{Path: "/api", Rate: 0},
+		{Path: "/api", Rate: 1, Burst: -1},
+		{Path: "/api", Rate: 1, By: "cookie"},
+		{Path: "/", Rate: 1},
+	} {
+		if err := opts.AddRateLimit(l); err == nil {
+			t.Errorf("%+v: expected an error", l)
+		}
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newLimitListener(inner, 1)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	first := <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("Second connection accepted while the first is open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("Second connection not accepted after the first closed")
+	}
+
+	ln.Close()
+	if _, ok := <-accepted; ok {
+		t.Error("Expected Accept to stop after Close")
+	}
+}
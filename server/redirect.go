@@ -0,0 +1,72 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HSTS sets the Strict-Transport-Security header sent on https
+// responses. A zero MaxAge means no header is sent
+type HSTS struct {
+	MaxAge            time.Duration
+	IncludeSubdomains bool
+	Preload           bool
+}
+
+func (h HSTS) String() string {
+	v := "max-age=" + strconv.FormatInt(int64(h.MaxAge/time.Second), 10)
+	if h.IncludeSubdomains {
+		v += "; includeSubDomains"
+	}
+	if h.Preload {
+		v += "; preload"
+	}
+	return v
+}
+
+// buildRedirect gives the https URL for req. port is the https port, or
+// empty for the default. Behind a trusted proxy that sent
+// X-Forwarded-Host, the host the client used is kept as it is
+func buildRedirect(port string, req *http.Request) string {
+	if f := getForwarded(req); f != nil && f.host {
+		return "https://" + req.Host + req.URL.RequestURI()
+	}
+
+	var host string
+	if strings.Contains(req.Host, ":") {
+		host, _, _ = net.SplitHostPort(req.Host)
+	} else {
+		host = req.Host
+	}
+
+	if port != "" {
+		return "https://" + host + ":" + port + req.URL.RequestURI()
+	}
+	return "https://" + host + req.URL.RequestURI()
+}
+
+// redirectHandler sends everything to https on port
+func redirectHandler(port string, status int, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Connection", "close")
+		url := buildRedirect(port, req)
+		log.Debug("Redirecting", "url", url)
+		http.Redirect(w, req, url, status)
+	})
+}
+
+// hstsHandler adds a Strict-Transport-Security header to responses
+func hstsHandler(policy HSTS, next http.Handler) http.Handler {
+	if policy.MaxAge <= 0 {
+		return next
+	}
+	value := policy.String()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectListener(t *testing.T) {
+	var opts Options
+	if err := opts.AddAddr(":8080", ":8443"); err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.SetRedirectStatus(http.StatusPermanentRedirect); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var redirect *http.Server
+	for _, h := range s.servers {
+		if s.redirects[h] {
+			redirect = h
+		}
+	}
+	if redirect == nil {
+		t.Fatal("No redirect server")
+	}
+
+	w := httptest.NewRecorder()
+	redirect.Handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com:8080/a?b=c", nil))
+	if w.Code != http.StatusPermanentRedirect {
+		t.Errorf("Expected status 308, got %d", w.Code)
+	}
+	if l := w.Header().Get("Location"); l != "https://example.com:8443/a?b=c" {
+		t.Errorf("Unexpected location %q", l)
+	}
+
+	// ACME challenges are answered by autocert, not redirected
+	w = httptest.NewRecorder()
+	redirect.Handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/.well-known/acme-challenge/token", nil))
+	if w.Code == http.StatusPermanentRedirect {
+		t.Error("ACME challenge shouldn't be redirected")
+	}
+}
+
+func TestHSTSHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	hstsHandler(HSTS{}, ok).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if h := w.Header().Get("Strict-Transport-Security"); h != "" {
+		t.Errorf("Expected no HSTS header, got %q", h)
+	}
+
+	w = httptest.NewRecorder()
+	hstsHandler(HSTS{MaxAge: 3600e9, Preload: true}, ok).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if h := w.Header().Get("Strict-Transport-Security"); h != "max-age=3600; preload" {
+		t.Errorf("Unexpected HSTS header %q", h)
+	}
+}
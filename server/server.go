@@ -2,17 +2,16 @@
 package server
 
 import (
-	"context"
 	"crypto/tls"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
-	"time"
+	"syscall"
 
-	"github.com/gorilla/handlers"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -21,42 +20,59 @@ type Server struct {
 	Options
 	servers []*http.Server
 	mux     *http.ServeMux
-}
+	// picks mux, or a virtual host's mux
+	router     *router
+	middleware []Middleware
+	// router wrapped in middleware
+	handler http.Handler
+	// sent by Recover, see SetErrorPage
+	errorPage   http.Handler
+	certManager *autocert.Manager
+	certStore   *certStore
+	// servers that only redirect to https
+	redirects map[*http.Server]bool
+	// listener settings for each server
+	serverListeners map[*http.Server]listener
 
-func buildRedirect(httpsAddr string, req *http.Request) string {
-	var host string
-	if strings.Contains(req.Host, ":") {
-		host, _, _ = net.SplitHostPort(req.Host)
-	} else {
-		host = req.Host
-	}
+	// bound listeners, one for each server
+	sockets []net.Listener
 
-	if strings.Contains(httpsAddr, ":") {
-		_, port, _ := net.SplitHostPort(httpsAddr)
-		return "https://" + host + ":" + port + req.URL.String()
-	}
-	return "https://" + host + req.URL.String()
+	// log is for everything the server logs apart from requests
+	log       *slog.Logger
+	accessLog *slog.Logger
+	logFields []func(r *http.Request) []slog.Attr
+	userKey   func(r *http.Request) string
+
+	metrics    *requestMetrics
+	collectors []func(w io.Writer)
+	// served by admin listeners
+	admin *http.ServeMux
+
+	// stateStarting, stateServing or stateDraining, for readiness
+	state       int32
+	readyChecks []readyCheck
+
+	proxyHandlers []*ProxyHandler
+
+	hooks []shutdownHook
+	// closed when shutdown starts
+	done chan struct{}
 }
 
-// Create creates a new server
-func Create(opts Options) *Server {
+// Create creates a new server. It fails if the https certificates are
+// files that can't be loaded, or a proxy can't be added
+func Create(opts Options) (*Server, error) {
 	s := &Server{
-		Options: opts,
-		mux:     http.NewServeMux(),
-	}
-	for i, a := range s.httpAddr {
-		s.servers = append(s.servers, &http.Server{
-			Addr:         a,
-			ReadTimeout:  5 * time.Second,
-			WriteTimeout: 5 * time.Second,
-			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-				w.Header().Set("Connection", "close")
-				url := buildRedirect(s.httpsAddr[i], req)
-				log.Printf("Redirecting to %s", url)
-				http.Redirect(w, req, url, http.StatusMovedPermanently)
-			}),
-		})
+		Options:         opts,
+		mux:             http.NewServeMux(),
+		redirects:       make(map[*http.Server]bool),
+		serverListeners: make(map[*http.Server]listener),
+		metrics:         newRequestMetrics(),
+		admin:           http.NewServeMux(),
+		done:            make(chan struct{}),
 	}
+	s.log = s.Logger("server")
+	s.accessLog = s.Logger("access")
 
 	tlsConfig := &tls.Config{
 		PreferServerCipherSuites: true,
@@ -74,41 +90,101 @@ func Create(opts Options) *Server {
 			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
 		},
 	}
-	if !s.debug {
-		m := &autocert.Manager{
-			Cache:      autocert.DirCache("tls"),
-			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist("moosemorals.com", "www.moosemorals.com"),
+	if s.hasHTTPS() {
+		switch s.getTLSMode() {
+		case TLSAutocert:
+			s.certManager = newCertManager(&s.Options)
+			tlsConfig.GetCertificate = s.certManager.GetCertificate
+			tlsConfig.NextProtos = s.certManager.TLSConfig().NextProtos
+		case TLSFiles, TLSDebug:
+			files := s.certFiles
+			if s.getTLSMode() == TLSDebug {
+				files = debugCertFiles
+			}
+			var err error
+			if s.certStore, err = newCertStore(files, s.log); err != nil {
+				return nil, err
+			}
+			tlsConfig.GetCertificate = s.certStore.GetCertificate
 		}
-		tlsConfig.GetCertificate = m.GetCertificate
-		tlsConfig.NextProtos = m.TLSConfig().NextProtos
 	}
 
-	for _, a := range s.httpsAddr {
-		s.servers = append(s.servers, &http.Server{
-			Addr:         a,
-			ReadTimeout:  15 * time.Second,
-			WriteTimeout: 60 * time.Second,
-			IdleTimeout:  120 * time.Second,
-			TLSConfig:    tlsConfig,
-			Handler:      handlers.CombinedLoggingHandler(os.Stdout, s.mux),
-		})
+	rt := s.redirectTimeouts.orDefault(defaultRedirectTimeouts)
+	t := s.timeouts.orDefault(defaultTimeouts)
+	s.router = newRouter(s.mux, s.getRedirectStatus())
+	for _, v := range s.vhosts {
+		s.addVirtualHost(v)
+	}
+	for _, p := range s.proxies {
+		if err := s.HandleProxy(p); err != nil {
+			return nil, fmt.Errorf("Can't add proxy for %s: %v", p.Path, err)
+		}
+	}
+	s.handler = s.router
+	s.Use(s.builtins.middleware(http.HandlerFunc(s.serveErrorPage), s.log)...)
+	site := s.trustProxies(s.logRequests(s.countRequests(s.rateLimit(s))))
+	s.admin.Handle("/metrics", s.MetricsHandler())
+	s.handleStatus(s.admin)
+	if s.publicStatus {
+		s.handleStatus(s.mux)
+	} else if !s.hasAdmin() {
+		// Nowhere else to check the server is up. Readiness and the
+		// version say too much to be public without asking
+		s.mux.HandleFunc("/healthz", s.handleHealth)
 	}
-	return s
-}
-
-// Handle a http request to a path
-func (s *Server) Handle(path string, h http.Handler) {
-	s.mux.Handle(path, h)
-}
 
-// OnShutdown passes f to the http.Server.RegisterShutdown function
-func (s *Server) OnShutdown(f func()) {
-	for _, h := range s.servers {
-		if getProto(h) == "HTTPS" {
-			h.RegisterOnShutdown(f)
+	for _, l := range s.listeners {
+		switch l.kind {
+		case listenRedirect:
+			var h http.Handler = redirectHandler(redirectPort(l.redirectTo), s.getRedirectStatus(), s.log)
+			if s.certManager != nil {
+				// Answer HTTP-01 challenges, redirect everything else
+				h = s.certManager.HTTPHandler(h)
+			}
+			h = s.trustProxies(h)
+			server := &http.Server{
+				Addr:         l.addr,
+				ReadTimeout:  rt.Read,
+				WriteTimeout: rt.Write,
+				IdleTimeout:  rt.Idle,
+				Handler:      h,
+			}
+			s.redirects[server] = true
+			s.servers = append(s.servers, server)
+		case listenHTTP:
+			s.servers = append(s.servers, &http.Server{
+				Addr:         l.addr,
+				ReadTimeout:  t.Read,
+				WriteTimeout: t.Write,
+				IdleTimeout:  t.Idle,
+				Handler:      site,
+			})
+		case listenHTTPS:
+			s.servers = append(s.servers, &http.Server{
+				Addr:         l.addr,
+				ReadTimeout:  t.Read,
+				WriteTimeout: t.Write,
+				IdleTimeout:  t.Idle,
+				TLSConfig:    tlsConfig,
+				Handler:      hstsHandler(s.hsts, site),
+			})
+		case listenAdmin:
+			s.servers = append(s.servers, &http.Server{
+				Addr:         l.addr,
+				ReadTimeout:  rt.Read,
+				WriteTimeout: rt.Write,
+				IdleTimeout:  rt.Idle,
+				Handler:      s.admin,
+			})
 		}
+		s.serverListeners[s.servers[len(s.servers)-1]] = l
 	}
+	return s, nil
+}
+
+// Handle a http request to a path, running any middleware first
+func (s *Server) Handle(path string, h http.Handler, mw ...Middleware) {
+	s.mux.Handle(path, chain(h, mw...))
 }
 
 func getProto(h *http.Server) string {
@@ -118,48 +194,102 @@ func getProto(h *http.Server) string {
 	return "HTTP"
 }
 
-// Start starts a server
-func (s *Server) Start() {
-	idleConnsClosed := make(chan struct{})
-	go func() {
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt)
+// Start binds all the listeners and serves until the server gets
+// SIGINT or SIGTERM, then shuts down gracefully. It returns an error
+// if a listener couldn't be bound or stopped serving unexpectedly
+func (s *Server) Start() error {
+	for server, l := range s.serverListeners {
+		if l.proxyProtocol && !s.hasTrustedProxies() {
+			return fmt.Errorf("%s server %s uses the PROXY protocol, but no proxies are trusted", getProto(server), server.Addr)
+		}
+	}
 
-		// Wait for signals
-		<-sigint
+	pool, err := inheritListeners()
+	if err != nil {
+		return err
+	}
 
-		log.Printf("Shutting down")
-		for _, server := range s.servers {
-			if err := server.Shutdown(context.Background()); err != nil {
-				log.Printf("%s server %s shutdown error: %v", getProto(server), server.Addr, err)
+	for _, server := range s.servers {
+		var ln net.Listener
+		if ln, pool = takeInherited(pool, server.Addr); ln != nil {
+			s.log.Info("Using inherited socket", "proto", getProto(server), "addr", server.Addr)
+		} else if ln, err = listen(server.Addr); err != nil {
+			for _, l := range s.sockets {
+				l.Close()
 			}
+			return fmt.Errorf("%s server %s error listening: %v", getProto(server), server.Addr, err)
 		}
-		close(idleConnsClosed)
-	}()
+		s.sockets = append(s.sockets, ln)
+	}
+	for _, in := range pool {
+		s.log.Warn("Closing unused inherited socket", "addr", in.ln.Addr())
+		in.ln.Close()
+	}
+	s.setState(stateServing)
+
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	defer signal.Stop(usr2)
+
+	if s.certStore != nil {
+		go s.certStore.watch(s.done)
+	}
+	for _, p := range s.proxyHandlers {
+		go p.Watch(s.done)
+	}
 
-	for _, x := range s.servers {
-		go func(server *http.Server) {
+	failed := make(chan error, len(s.servers))
+	for i, x := range s.servers {
+		go func(server *http.Server, ln net.Listener) {
 			proto := getProto(server)
+			s.log.Info("Listening", "proto", proto, "addr", server.Addr)
+
+			ln = s.wrapListener(server, ln)
+			var err error
 			if proto == "HTTP" {
-				log.Printf("HTTP server listening on %s", server.Addr)
-				if err := server.ListenAndServe(); err != http.ErrServerClosed {
-					log.Printf("HTTP server %s error ListenAndServe: %v", server.Addr, err)
-				}
+				err = server.Serve(ln)
 			} else {
-				log.Printf("HTTPS server listening on %s", server.Addr)
-				var err error
-				if !s.debug {
-					err = server.ListenAndServeTLS("", "")
-				} else {
-					err = server.ListenAndServeTLS("cert.pem", "key.pem")
-				}
-				if err != http.ErrServerClosed {
-					log.Printf("HTTPS server %s error ListenAndServeTLS: %v", server.Addr, err)
-				}
+				err = server.ServeTLS(ln, "", "")
+			}
+			if err != http.ErrServerClosed {
+				failed <- fmt.Errorf("%s server %s error serving: %v", proto, server.Addr, err)
+			}
+		}(x, s.sockets[i])
+	}
+	s.handoffComplete()
 
+	// set while a new server is starting, so SIGUSR2 doesn't start
+	// another one
+	var child <-chan struct{}
+wait:
+	for {
+		select {
+		case got := <-sig:
+			s.log.Info("Got signal", "signal", got)
+			break wait
+		case err = <-failed:
+			s.log.Error("Server failed", "err", err)
+			break wait
+		case <-usr2:
+			if child != nil {
+				s.log.Warn("Got SIGUSR2, but a new server is already starting")
+				continue
+			}
+			s.log.Info("Got SIGUSR2, handing over to a new server")
+			var herr error
+			if child, herr = s.handoff(); herr != nil {
+				s.log.Error("Can't hand over", "err", herr)
 			}
-		}(x)
+		case <-child:
+			s.log.Warn("New server didn't take over, carrying on")
+			child = nil
+		}
 	}
-	// Wait for shutdown
-	<-idleConnsClosed
+
+	s.shutdown(sig)
+	return err
 }
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// When shutdown hooks run
+const (
+	// As soon as shutdown starts, while connections drain
+	hookStart = iota
+	// After all the connections have drained, or been closed
+	hookDrained
+)
+
+type shutdownHook struct {
+	name string
+	when int
+	run  func(ctx context.Context) error
+}
+
+// OnShutdown runs f as soon as the server starts to shut down, while
+// connections are draining. Use it to close connections that the http
+// servers don't track, like websockets. f is given the hook timeout
+// to finish, after which shutdown carries on without it
+func (s *Server) OnShutdown(f func()) {
+	s.hooks = append(s.hooks, shutdownHook{
+		name: "OnShutdown",
+		when: hookStart,
+		run: func(ctx context.Context) error {
+			f()
+			return nil
+		},
+	})
+}
+
+// AddShutdownHook runs f after all connections have drained. Hooks
+// run one at a time in the order they were added, and each gets a
+// context that is cancelled when the hook timeout runs out
+func (s *Server) AddShutdownHook(name string, f func(ctx context.Context) error) {
+	s.hooks = append(s.hooks, shutdownHook{
+		name: name,
+		when: hookDrained,
+		run:  f,
+	})
+}
+
+// runHooks runs the hooks for a stage, in order
+func (s *Server) runHooks(when int) {
+	timeout := s.getShutdownTimeouts().Hook
+	for _, h := range s.hooks {
+		if h.when != when {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		result := make(chan error, 1)
+		go func(h shutdownHook) {
+			result <- h.run(ctx)
+		}(h)
+
+		select {
+		case err := <-result:
+			if err != nil {
+				s.log.Error("Shutdown hook failed", "hook", h.name, "err", err)
+			}
+		case <-ctx.Done():
+			s.log.Warn("Shutdown hook didn't finish in time, carrying on", "hook", h.name, "timeout", timeout)
+		}
+		cancel()
+	}
+}
+
+// shutdown stops the servers, giving connections time to drain
+// before closing them. A signal on sig cuts the wait short
+func (s *Server) shutdown(sig <-chan os.Signal) {
+	s.log.Info("Shutting down")
+	s.setState(stateDraining)
+	close(s.done)
+
+	t := s.getShutdownTimeouts()
+	if t.Delay > 0 {
+		// Keep serving while load balancers see /readyz fail
+		s.log.Info("Waiting before closing listeners", "delay", t.Delay)
+		select {
+		case got := <-sig:
+			s.log.Warn("Got signal, not waiting to close listeners", "signal", got)
+		case <-time.After(t.Delay):
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.Drain)
+	defer cancel()
+
+	go func() {
+		select {
+		case got := <-sig:
+			s.log.Warn("Got signal, not waiting for connections to drain", "signal", got)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, x := range s.servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				s.log.Warn("Server didn't shut down cleanly, closing", "proto", getProto(server), "addr", server.Addr, "err", err)
+				server.Close()
+			}
+		}(x)
+	}
+
+	s.runHooks(hookStart)
+	wg.Wait()
+	s.runHooks(hookDrained)
+	s.log.Info("Shutdown complete")
+}
+
+// ShutdownTimeouts control how long shutdown waits
+type ShutdownTimeouts struct {
+	// Delay is how long the server keeps serving after /readyz starts
+	// failing, so load balancers can stop sending it traffic first.
+	// There's no delay by default
+	Delay time.Duration
+	// Drain is how long open connections get to finish
+	Drain time.Duration
+	// Hook is how long each shutdown hook gets
+	Hook time.Duration
+}
+
+var defaultShutdownTimeouts = ShutdownTimeouts{
+	Drain: 30 * time.Second,
+	Hook:  10 * time.Second,
+}
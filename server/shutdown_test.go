@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShutdownHookOrder(t *testing.T) {
+	var opts Options
+	opts.SetShutdownTimeouts(ShutdownTimeouts{Drain: time.Second, Hook: 50 * time.Millisecond})
+	s, err := Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	s.AddShutdownHook("first", func(ctx context.Context) error {
+		order = append(order, "first")
+		return nil
+	})
+	s.OnShutdown(func() {
+		order = append(order, "start")
+	})
+	s.AddShutdownHook("slow", func(ctx context.Context) error {
+		// Never finishes, shutdown should carry on without it
+		select {}
+	})
+	s.AddShutdownHook("last", func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("Hook context should have a deadline")
+		}
+		order = append(order, "last")
+		return nil
+	})
+
+	s.shutdown(make(chan os.Signal))
+
+	expected := []string{"start", "first", "last"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("Expected hooks in order %v, got %v", expected, order)
+	}
+}
+
+func TestStartBindError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var opts Options
+	if err := opts.AddHTTP(ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- s.Start()
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected an error binding to a port in use")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return")
+	}
+}
+
+func TestShutdownDelay(t *testing.T) {
+	var opts Options
+	opts.SetShutdownTimeouts(ShutdownTimeouts{Delay: time.Hour, Drain: time.Second})
+	s, err := Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		s.shutdown(sig)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Shutdown should wait for the delay")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, ok := s.ready(); ok {
+		t.Error("Should not be ready during the delay")
+	}
+
+	sig <- os.Interrupt
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("A signal should cut the delay short")
+	}
+}
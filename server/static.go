@@ -0,0 +1,340 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pages served from the root of a Static handler instead of the plain ones
+const (
+	notFoundFile = "404.html"
+	errorFile    = "500.html"
+)
+
+// Cache-Control for names made by Fingerprint, which never change, and
+// for everything else, which has to be checked with the ETag
+const (
+	cacheImmutable  = "public, max-age=31536000, immutable"
+	cacheRevalidate = "no-cache"
+)
+
+// Names that look like they already have a hex hash before the
+// extension, like core.3f2a9c1b.css, which Fingerprint leaves alone.
+// They aren't cached for long unless Fingerprint made them, since
+// plenty of names look like this by chance
+var fingerprinted = regexp.MustCompile(`\.[0-9a-f]{8,64}\.[A-Za-z0-9]+$`)
+
+// Precompressed siblings, best first
+var precompressed = []struct {
+	encoding, ext string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+type etagEntry struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+// Static serves files. Unlike http.FileServer, it doesn't list
+// directories or serve dotfiles, it serves .br and .gz copies of files
+// to clients that accept them, and it sends an ETag and Cache-Control
+// with everything. 404.html and 500.html, if there are any, are used
+// for errors. See Fingerprint for long lived caching of CSS and JS
+type Static struct {
+	fsys fs.FS
+
+	mu sync.Mutex
+	// hashes of the files, by name
+	etags        map[string]etagEntry
+	fingerprints *fingerprints
+}
+
+// NewStatic serves files from fsys, usually os.DirFS, an embed.FS, or
+// an Overlay of both
+func NewStatic(fsys fs.FS) *Static {
+	return &Static{
+		fsys:  fsys,
+		etags: make(map[string]etagEntry),
+	}
+}
+
+// overlay is a stack of file systems, see Overlay
+type overlay []fs.FS
+
+// Overlay makes a file system from layers. Each file comes from the
+// first layer that has it, so a directory on disk can override files
+// that are built into the binary
+func Overlay(layers ...fs.FS) fs.FS {
+	return overlay(layers)
+}
+
+func (o overlay) Open(name string) (fs.File, error) {
+	for _, layer := range o {
+		f, err := layer.Open(name)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// hidden checks if any part of a path starts with a dot. .well-known
+// is allowed, for things like security.txt
+func hidden(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") && part != ".well-known" {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Static) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if hidden(name) {
+		h.NotFound(w, r)
+		return
+	}
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		name = "."
+	}
+
+	f := h.getFingerprints()
+	var a *page
+	if f != nil {
+		a = f.asset(name)
+	}
+	if a != nil {
+		// What was hashed, which is what's in the file now unless it's
+		// changed since it was checked. Precompressed copies weren't
+		// hashed, so they aren't used
+		header := w.Header()
+		if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+			header.Set("Content-Type", ctype)
+		}
+		header.Set("Cache-Control", cacheImmutable)
+		header.Set("ETag", a.etag)
+		http.ServeContent(w, r, name, a.modTime, bytes.NewReader(a.data))
+		return
+	}
+
+	info, err := fs.Stat(h.fsys, name)
+	if err != nil {
+		h.serveError(w, r, name, err)
+		return
+	}
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			// Relative links in the index need the slash. The
+			// redirect is relative too, in case a prefix was stripped
+			target := path.Base(r.URL.Path) + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			w.Header().Set("Location", target)
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+		name = path.Join(name, "index.html")
+		if info, err = fs.Stat(h.fsys, name); err == nil && info.IsDir() {
+			err = fs.ErrNotExist
+		}
+		if err != nil {
+			h.serveError(w, r, name, err)
+			return
+		}
+	}
+
+	header := w.Header()
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype != "" {
+		header.Set("Content-Type", ctype)
+	}
+	header.Set("Cache-Control", cacheRevalidate)
+	if !hasVary(header, "Accept-Encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if f != nil && path.Ext(name) == ".html" {
+		p, err := f.page(name, info)
+		if err != nil {
+			h.serveError(w, r, name, err)
+			return
+		}
+		if p != nil {
+			// Precompressed copies would have the old links
+			header.Set("ETag", p.etag)
+			http.ServeContent(w, r, name, p.modTime, bytes.NewReader(p.data))
+			return
+		}
+	}
+
+	file := name
+	br, gz := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+	accepted := map[string]bool{"br": br, "gzip": gz}
+	for _, p := range precompressed {
+		if !accepted[p.encoding] {
+			continue
+		}
+		if ci, err := fs.Stat(h.fsys, name+p.ext); err == nil && ci.Mode().IsRegular() {
+			file, info = name+p.ext, ci
+			header.Set("Content-Encoding", p.encoding)
+			if ctype == "" {
+				// Don't let ServeContent sniff the compressed bytes
+				header.Set("Content-Type", "application/octet-stream")
+			}
+			break
+		}
+	}
+
+	content, err := h.open(file)
+	if err != nil {
+		h.serveError(w, r, file, err)
+		return
+	}
+	defer content.Close()
+
+	etag, err := h.etag(file, info, content)
+	if err != nil {
+		h.serveError(w, r, file, err)
+		return
+	}
+	header.Set("ETag", etag)
+
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+type readSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// open opens a file for ServeContent, which needs to seek
+func (h *Static) open(name string) (readSeekCloser, error) {
+	f, err := h.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if rs, ok := f.(readSeekCloser); ok {
+		return rs, nil
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(b)}, nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// etag gives a strong ETag for a file from a hash of its contents. The
+// hash is kept until the file's size or modification time changes
+func (h *Static) etag(name string, info fs.FileInfo, f io.ReadSeeker) (string, error) {
+	h.mu.Lock()
+	e, ok := h.etags[name]
+	h.mu.Unlock()
+	if ok && e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+		return e.etag, nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+
+	h.mu.Lock()
+	h.etags[name] = etagEntry{modTime: info.ModTime(), size: info.Size(), etag: etag}
+	h.mu.Unlock()
+	return etag, nil
+}
+
+func hasVary(header http.Header, name string) bool {
+	for _, v := range headerList(header, "Vary") {
+		if strings.EqualFold(v, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveError sends 404 for missing files, and 500 for anything else
+func (h *Static) serveError(w http.ResponseWriter, r *http.Request, name string, err error) {
+	w.Header().Del("Content-Encoding")
+	w.Header().Del("Cache-Control")
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+		h.NotFound(w, r)
+		return
+	}
+	logger.Error("Can't serve file", "file", name, "err", err)
+	h.ErrorPage().ServeHTTP(w, r)
+}
+
+// NotFound sends 404.html with a 404 status, or a plain message if
+// there isn't one
+func (h *Static) NotFound(w http.ResponseWriter, r *http.Request) {
+	if !h.servePage(w, notFoundFile, http.StatusNotFound) {
+		http.NotFound(w, r)
+	}
+}
+
+// ErrorPage sends 500.html with a 500 status, or a plain page if there
+// isn't one. It can be passed to Server.SetErrorPage
+func (h *Static) ErrorPage() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.servePage(w, errorFile, http.StatusInternalServerError) {
+			serveDefaultErrorPage(w, r)
+		}
+	})
+}
+
+// servePage sends an error page with status. It reports false if the
+// page can't be read
+func (h *Static) servePage(w http.ResponseWriter, name string, status int) bool {
+	b, err := fs.ReadFile(h.fsys, name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger.Error("Can't read error page", "file", name, "err", err)
+		}
+		return false
+	}
+
+	header := w.Header()
+	for _, k := range []string{"Content-Encoding", "Content-Length", "ETag", "Last-Modified"} {
+		header.Del(k)
+	}
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Cache-Control", cacheRevalidate)
+	w.WriteHeader(status)
+	w.Write(b)
+	return true
+}
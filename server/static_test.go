@@ -0,0 +1,197 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func testStatic() *Static {
+	return NewStatic(fstest.MapFS{
+		"index.html":               {Data: []byte("<p>home</p>")},
+		"404.html":                 {Data: []byte("<p>lost</p>")},
+		"css/core.css":             {Data: []byte("body {}")},
+		"css/core.css.gz":          {Data: []byte("gzipped")},
+		"css/core.css.br":          {Data: []byte("brotli")},
+		"js/app.3f2a9c1b.js":       {Data: []byte("alert(1)")},
+		"images/a.png":             {Data: []byte("png")},
+		".env":                     {Data: []byte("SECRET=1")},
+		".git/config":              {Data: []byte("[core]")},
+		".well-known/security.txt": {Data: []byte("Contact: x")},
+	})
+}
+
+func getStatic(h http.Handler, path string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestStatic(t *testing.T) {
+	h := testStatic()
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/", 200, "<p>home</p>"},
+		{"/css/core.css", 200, "body {}"},
+		{"/.well-known/security.txt", 200, "Contact: x"},
+		// No listings
+		{"/images/", 404, "<p>lost</p>"},
+		{"/missing", 404, "<p>lost</p>"},
+		// No dotfiles
+		{"/.env", 404, "<p>lost</p>"},
+		{"/.git/config", 404, "<p>lost</p>"},
+		{"/css/../.env", 404, "<p>lost</p>"},
+	}
+	for _, tc := range tests {
+		w := getStatic(h, tc.path)
+		if w.Code != tc.status || w.Body.String() != tc.body {
+			t.Errorf("%s: expected %d %q, got %d %q", tc.path, tc.status, tc.body, w.Code, w.Body.String())
+		}
+	}
+
+	w := getStatic(h, "/images?x=1")
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "images/?x=1" {
+		t.Errorf("Expected a redirect to the directory, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestStaticPrecompressed(t *testing.T) {
+	h := testStatic()
+
+	tests := []struct {
+		accept, encoding, body string
+	}{
+		{"", "", "body {}"},
+		{"gzip", "gzip", "gzipped"},
+		{"gzip, br", "br", "brotli"},
+		{"br;q=0, gzip", "gzip", "gzipped"},
+	}
+	for _, tc := range tests {
+		w := getStatic(h, "/css/core.css", "Accept-Encoding", tc.accept)
+		if got := w.Header().Get("Content-Encoding"); got != tc.encoding || w.Body.String() != tc.body {
+			t.Errorf("%q: expected %q %q, got %q %q", tc.accept, tc.encoding, tc.body, got, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+			t.Errorf("%q: expected text/css, got %q", tc.accept, ct)
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%q: expected Vary: Accept-Encoding, got %q", tc.accept, w.Header()["Vary"])
+		}
+	}
+
+	plain := getStatic(h, "/css/core.css").Header().Get("ETag")
+	gz := getStatic(h, "/css/core.css", "Accept-Encoding", "gzip").Header().Get("ETag")
+	if plain == "" || plain == gz {
+		t.Errorf("Expected different ETags, got %q and %q", plain, gz)
+	}
+}
+
+func TestStaticCaching(t *testing.T) {
+	h := testStatic()
+
+	w := getStatic(h, "/css/core.css")
+	if cc := w.Header().Get("Cache-Control"); cc != cacheRevalidate {
+		t.Errorf("Expected %q, got %q", cacheRevalidate, cc)
+	}
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("Expected a strong ETag, got %q", etag)
+	}
+
+	w = getStatic(h, "/css/core.css", "If-None-Match", etag)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304, got %d", w.Code)
+	}
+	w = getStatic(h, "/css/core.css", "If-None-Match", "W/"+etag)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a weak match, got %d", w.Code)
+	}
+
+	// Only names made by Fingerprint are cached for long
+	w = getStatic(h, "/js/app.3f2a9c1b.js")
+	if cc := w.Header().Get("Cache-Control"); cc != cacheRevalidate {
+		t.Errorf("Expected %q for a name that wasn't fingerprinted, got %q", cacheRevalidate, cc)
+	}
+	if err := h.Fingerprint(); err != nil {
+		t.Fatal(err)
+	}
+	w = getStatic(h, "/js/app.3f2a9c1b.js")
+	if cc := w.Header().Get("Cache-Control"); cc != cacheRevalidate {
+		t.Errorf("Expected %q for a name that looks fingerprinted, got %q", cacheRevalidate, cc)
+	}
+	w = getStatic(h, h.AssetPath("/css/core.css"))
+	if cc := w.Header().Get("Cache-Control"); cc != cacheImmutable {
+		t.Errorf("Expected %q for a fingerprinted file, got %q", cacheImmutable, cc)
+	}
+}
+
+type brokenFS struct {
+	fstest.MapFS
+}
+
+func (f brokenFS) Open(name string) (fs.File, error) {
+	if name == "broken.txt" {
+		return nil, errors.New("disk on fire")
+	}
+	return f.MapFS.Open(name)
+}
+
+func TestStaticErrorPages(t *testing.T) {
+	h := NewStatic(brokenFS{fstest.MapFS{
+		"broken.txt": {Data: []byte("x")},
+		"500.html":   {Data: []byte("<p>oops</p>")},
+	}})
+
+	w := getStatic(h, "/broken.txt")
+	if w.Code != http.StatusInternalServerError || w.Body.String() != "<p>oops</p>" {
+		t.Errorf("Expected the 500 page, got %d %q", w.Code, w.Body.String())
+	}
+
+	// No 404.html
+	w = getStatic(h, "/missing")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+
+	s := &Server{}
+	s.SetErrorPage(h.ErrorPage())
+	panics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	site := chain(panics, Builtins{Recover: true}.middleware(http.HandlerFunc(s.serveErrorPage), s.log)...)
+	w = getStatic(site, "/")
+	if w.Code != http.StatusInternalServerError || w.Body.String() != "<p>oops</p>" {
+		t.Errorf("Expected Recover to send the 500 page, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	h := NewStatic(Overlay(
+		fstest.MapFS{"index.html": {Data: []byte("edited")}},
+		fstest.MapFS{
+			"index.html":   {Data: []byte("built in")},
+			"css/core.css": {Data: []byte("body {}")},
+		},
+	))
+
+	for path, body := range map[string]string{"/": "edited", "/css/core.css": "body {}"} {
+		if w := getStatic(h, path); w.Code != http.StatusOK || w.Body.String() != body {
+			t.Errorf("%s: expected %q, got %d %q", path, body, w.Code, w.Body.String())
+		}
+	}
+	if w := getStatic(h, "/missing"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// trustUnix, passed to AddTrustedProxy, trusts anything connecting
+// over a unix socket
+const trustUnix = "unix"
+
+const forwardedKey = contextKey("forwarded")
+
+// forwarded is what the server was told by a trusted proxy
+type forwarded struct {
+	// X-Forwarded-For from the proxy, including the proxy's own address
+	chain  string
+	scheme string
+	// true if X-Forwarded-Host was used
+	host bool
+}
+
+// AddTrustedProxy trusts X-Forwarded-* headers and PROXY protocol
+// headers from cidr, which can also be a single address, or "unix"
+// for connections over unix sockets
+func (o *Options) AddTrustedProxy(cidr string) error {
+	if cidr == trustUnix {
+		o.trustUnix = true
+		return nil
+	}
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return errors.New("Expected an address or CIDR")
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		o.trustedProxies = append(o.trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return nil
+	}
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	o.trustedProxies = append(o.trustedProxies, n)
+	return nil
+}
+
+// SetProxyProtocol makes the listeners for addr expect a PROXY protocol
+// (v1 or v2) header from trusted proxies. Headers from anyone else
+// are refused
+func (o *Options) SetProxyProtocol(addr string) error {
+	found := false
+	for i := range o.listeners {
+		if o.listeners[i].addr == addr {
+			o.listeners[i].proxyProtocol = true
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("No listener with that address")
+	}
+	return nil
+}
+
+func (o *Options) hasTrustedProxies() bool {
+	return o.trustUnix || len(o.trustedProxies) != 0
+}
+
+// trustedIP checks if a proxy at ip is trusted
+func (o *Options) trustedIP(ip net.IP) bool {
+	for _, n := range o.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedAddr checks if a connection from addr is trusted. Addresses
+// that aren't IPs are unix sockets
+func (o *Options) trustedAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return o.trustUnix
+	}
+	return o.trustedIP(ip)
+}
+
+// clientIP works out the client from an X-Forwarded-For list. The
+// client is the last address that isn't a trusted proxy
+func (o *Options) clientIP(chain []string) string {
+	client := ""
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(chain[i])
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !o.trustedIP(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// headerList splits a comma separated header that may be sent more than once
+func headerList(h http.Header, name string) []string {
+	var out []string
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+// trustProxies uses X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host from trusted proxies to fill in the client address,
+// scheme and host. Requests from anyone else are left alone
+func (s *Server) trustProxies(next http.Handler) http.Handler {
+	if !s.hasTrustedProxies() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.trustedAddr(r.RemoteAddr) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		f := &forwarded{scheme: Scheme(r)}
+		r2 := r.WithContext(context.WithValue(r.Context(), forwardedKey, f))
+
+		chain := headerList(r.Header, "X-Forwarded-For")
+		if client := s.clientIP(chain); client != "" {
+			r2.RemoteAddr = net.JoinHostPort(client, "0")
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			chain = append(chain, host)
+		}
+		f.chain = strings.Join(chain, ", ")
+
+		if p := headerList(r.Header, "X-Forwarded-Proto"); len(p) != 0 {
+			if proto := strings.ToLower(p[0]); proto == "http" || proto == "https" {
+				f.scheme = proto
+			}
+		}
+		if h := headerList(r.Header, "X-Forwarded-Host"); len(h) != 0 && checkHost(hostOnly(h[0])) == nil {
+			r2.Host = h[0]
+			f.host = true
+		}
+
+		next.ServeHTTP(w, r2)
+	})
+}
+
+func getForwarded(r *http.Request) *forwarded {
+	f, _ := r.Context().Value(forwardedKey).(*forwarded)
+	return f
+}
+
+// Scheme gives the scheme the client used for r, "http" or "https".
+// Behind a trusted proxy, this comes from X-Forwarded-Proto
+func Scheme(r *http.Request) string {
+	if f := getForwarded(r); f != nil {
+		return f.scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// proxyPolicy accepts PROXY protocol headers from trusted proxies,
+// and refuses connections from anyone else that send one
+func (s *Server) proxyPolicy(upstream net.Addr) (proxyproto.Policy, error) {
+	if s.trustedAddr(upstream.String()) {
+		return proxyproto.USE, nil
+	}
+	return proxyproto.REJECT, nil
+}
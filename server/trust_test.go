@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	var opts Options
+	for _, p := range []string{"10.0.0.0/8", "192.0.2.1"} {
+		if err := opts.AddTrustedProxy(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		chain  []string
+		client string
+	}{
+		{nil, ""},
+		{[]string{"203.0.113.9"}, "203.0.113.9"},
+		{[]string{"203.0.113.9", "10.1.2.3", "192.0.2.1"}, "203.0.113.9"},
+		{[]string{"6.6.6.6", "203.0.113.9", "10.1.2.3"}, "203.0.113.9"},
+		{[]string{"10.0.0.5", "10.0.0.6"}, "10.0.0.5"},
+		{[]string{"203.0.113.9", "junk", "10.0.0.6"}, "10.0.0.6"},
+	}
+	for _, tc := range tests {
+		if got := opts.clientIP(tc.chain); got != tc.client {
+			t.Errorf("%v: expected %q, got %q", tc.chain, tc.client, got)
+		}
+	}
+}
+
+func TestTrustProxies(t *testing.T) {
+	var opts Options
+	opts.AddTrustedProxy("10.0.0.0/8")
+	s, err := Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *http.Request
+	h := s.trustProxies(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+
+	r := httptest.NewRequest("GET", "http://internal:8080/a", nil)
+	r.RemoteAddr = "10.0.0.2:5555"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "example.com")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if got.RemoteAddr != "203.0.113.9:0" || got.Host != "example.com" || Scheme(got) != "https" {
+		t.Errorf("Forwarded headers not used: %s %s %s", got.RemoteAddr, got.Host, Scheme(got))
+	}
+	if l := buildRedirect("8443", got); l != "https://example.com/a" {
+		t.Errorf("Redirect should use the forwarded host, got %s", l)
+	}
+
+	r.RemoteAddr = "198.51.100.1:5555"
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if got.RemoteAddr != "198.51.100.1:5555" || got.Host != "internal:8080" || Scheme(got) != "http" {
+		t.Errorf("Untrusted headers used: %s %s %s", got.RemoteAddr, got.Host, Scheme(got))
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	var opts Options
+	if err := opts.AddHTTP("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.SetProxyProtocol("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	opts.AddTrustedProxy("127.0.0.1")
+	s, err := Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	}))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := s.servers[0]
+	go server.Serve(s.wrapListener(server, ln))
+	defer server.Close()
+
+	get := func(header string) string {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n", header)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return err.Error()
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if got := get("PROXY TCP4 203.0.113.9 127.0.0.1 4444 80\r\n"); got != "203.0.113.9:4444" {
+		t.Errorf("Expected the address from the PROXY header, got %q", got)
+	}
+	if got := get(""); got == "203.0.113.9:4444" {
+		t.Errorf("Connections without a header should use their own address, got %q", got)
+	}
+}
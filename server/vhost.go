@@ -0,0 +1,215 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// VirtualHost serves a hostname with its own handlers, or redirects
+// it to another hostname. Requests for hosts that don't match any
+// virtual host go to the default site
+type VirtualHost struct {
+	// Host is a hostname like eve.example.com, or a wildcard like
+	// *.example.com that matches any subdomain (but not example.com)
+	Host string
+	// Mounts maps handler names to paths, like Options.SetMount
+	Mounts map[string]string
+	// RedirectTo sends requests for Host to this hostname instead,
+	// keeping the path. Used for canonical hosts, like www to apex
+	RedirectTo string
+}
+
+// AddVirtualHost adds a virtual host. Each host can only be added once
+func (o *Options) AddVirtualHost(v VirtualHost) error {
+	v.Host = strings.ToLower(v.Host)
+	if err := checkHostPattern(v.Host); err != nil {
+		return err
+	}
+	if v.RedirectTo != "" {
+		if len(v.Mounts) != 0 {
+			return errors.New("Can't have handlers and a redirect")
+		}
+		if err := checkHost(v.RedirectTo); err != nil {
+			return err
+		}
+		if strings.EqualFold(v.Host, v.RedirectTo) {
+			return errors.New("Can't redirect to itself")
+		}
+	}
+	for _, x := range o.vhosts {
+		if x.Host == v.Host {
+			return fmt.Errorf("Host %q added twice", v.Host)
+		}
+	}
+
+	mounts := make(map[string]string, len(v.Mounts))
+	for k, p := range v.Mounts {
+		mounts[k] = p
+	}
+	v.Mounts = mounts
+	o.vhosts = append(o.vhosts, v)
+	return nil
+}
+
+// VirtualHosts returns the virtual hosts, in the order they were added
+func (o *Options) VirtualHosts() []VirtualHost {
+	out := make([]VirtualHost, len(o.vhosts))
+	for i, v := range o.vhosts {
+		out[i] = v
+		out[i].Mounts = make(map[string]string, len(v.Mounts))
+		for k, p := range v.Mounts {
+			out[i].Mounts[k] = p
+		}
+	}
+	return out
+}
+
+// checkHostPattern makes sure h is a bare hostname, or *. followed by one
+func checkHostPattern(h string) error {
+	if strings.HasPrefix(h, "*.") {
+		h = h[2:]
+	}
+	if strings.Contains(h, "*") {
+		return fmt.Errorf("%q: wildcards are only allowed as *.example.com", h)
+	}
+	return checkHost(h)
+}
+
+// vhost is a virtual host, as set up by the server
+type vhost struct {
+	pattern    string
+	mux        *http.ServeMux
+	redirectTo string
+}
+
+// router picks the virtual host for each request
+type router struct {
+	exact map[string]*vhost
+	// longest suffix first
+	wildcards []*vhost
+	// the default site
+	fallback *http.ServeMux
+	status   int
+}
+
+func newRouter(fallback *http.ServeMux, status int) *router {
+	return &router{
+		exact:    make(map[string]*vhost),
+		fallback: fallback,
+		status:   status,
+	}
+}
+
+// add adds a virtual host, replacing any with the same pattern
+func (rt *router) add(v *vhost) {
+	if !strings.HasPrefix(v.pattern, "*.") {
+		rt.exact[v.pattern] = v
+		return
+	}
+	for i, w := range rt.wildcards {
+		if w.pattern == v.pattern {
+			rt.wildcards[i] = v
+			return
+		}
+	}
+	rt.wildcards = append(rt.wildcards, v)
+	sort.SliceStable(rt.wildcards, func(i, j int) bool {
+		return len(rt.wildcards[i].pattern) > len(rt.wildcards[j].pattern)
+	})
+}
+
+// find gives the virtual host for a Host header, or nil
+func (rt *router) find(host string) *vhost {
+	host = hostOnly(host)
+	if v, ok := rt.exact[host]; ok {
+		return v
+	}
+	for _, v := range rt.wildcards {
+		if strings.HasSuffix(host, v.pattern[1:]) {
+			return v
+		}
+	}
+	return nil
+}
+
+// get gives the virtual host with exactly this pattern, or nil
+func (rt *router) get(pattern string) *vhost {
+	for _, v := range rt.wildcards {
+		if v.pattern == pattern {
+			return v
+		}
+	}
+	return rt.exact[pattern]
+}
+
+// mux gives the mux that handles r, and the host pattern it belongs to.
+// The pattern is empty for the default site, and the mux is nil if
+// the host redirects
+func (rt *router) mux(r *http.Request) (*http.ServeMux, string) {
+	v := rt.find(r.Host)
+	if v == nil {
+		return rt.fallback, ""
+	}
+	if v.redirectTo != "" {
+		return nil, v.pattern
+	}
+	return v.mux, v.pattern
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v := rt.find(r.Host)
+	switch {
+	case v == nil:
+		rt.fallback.ServeHTTP(w, r)
+	case v.redirectTo != "":
+		http.Redirect(w, r, canonicalURL(v.redirectTo, r), rt.status)
+	default:
+		v.mux.ServeHTTP(w, r)
+	}
+}
+
+// canonicalURL gives the URL for r on another host, keeping the
+// scheme, port and path
+func canonicalURL(host string, r *http.Request) string {
+	scheme := Scheme(r)
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		host = net.JoinHostPort(host, port)
+	}
+	return scheme + "://" + host + r.URL.RequestURI()
+}
+
+// hostOnly lowercases a Host header and strips any port
+func hostOnly(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// HandleHost handles requests to path on a virtual host, running any
+// middleware first. The host is added if it wasn't set up in Options.
+// It panics if the host redirects, like http.ServeMux does for mistakes
+func (s *Server) HandleHost(host, path string, h http.Handler, mw ...Middleware) {
+	host = strings.ToLower(host)
+	v := s.router.get(host)
+	if v == nil {
+		v = s.addVirtualHost(VirtualHost{Host: host})
+	}
+	if v.redirectTo != "" {
+		panic(fmt.Sprintf("server: %s redirects to %s, it can't have handlers", host, v.redirectTo))
+	}
+	v.mux.Handle(path, chain(h, mw...))
+}
+
+func (s *Server) addVirtualHost(vh VirtualHost) *vhost {
+	v := &vhost{pattern: vh.Host, redirectTo: vh.RedirectTo}
+	if v.redirectTo == "" {
+		v.mux = http.NewServeMux()
+	}
+	s.router.add(v)
+	return v
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	var opts Options
+	vhosts := []VirtualHost{
+		{Host: "www.example.com", RedirectTo: "example.com"},
+		{Host: "eve.example.com"},
+		{Host: "*.example.com"},
+		{Host: "*.users.example.com"},
+	}
+	for _, v := range vhosts {
+		if err := opts.AddVirtualHost(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	say := func(what string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(what))
+		})
+	}
+	s.Handle("/", say("site"))
+	s.HandleHost("eve.example.com", "/", say("eve"))
+	s.HandleHost("*.example.com", "/", say("wildcard"))
+	s.HandleHost("*.users.example.com", "/", say("users"))
+	s.HandleHost("share.example.org", "/", say("share"))
+
+	tests := []struct {
+		url  string
+		body string
+	}{
+		{"http://example.com/", "site"},
+		{"http://other.org/", "site"},
+		{"http://eve.example.com/", "eve"},
+		{"http://EVE.example.com.:8080/", "eve"},
+		{"http://blog.example.com/", "wildcard"},
+		{"http://a.b.example.com/", "wildcard"},
+		{"http://bob.users.example.com/", "users"},
+		{"http://share.example.org/", "share"},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", tc.url, nil))
+		if w.Body.String() != tc.body {
+			t.Errorf("%s: expected %q, got %q", tc.url, tc.body, w.Body.String())
+		}
+	}
+
+	r := httptest.NewRequest("GET", "https://www.example.com:8443/a?b=c", nil)
+	r.TLS = &tls.ConnectionState{}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://example.com:8443/a?b=c" {
+		t.Errorf("Expected canonical redirect, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	if r := s.route(httptest.NewRequest("GET", "http://eve.example.com/x", nil)); r != "eve.example.com/" {
+		t.Errorf("Unexpected route %q", r)
+	}
+
+	hosts := opts.getHosts()
+	expected := []string{"moosemorals.com", "www.moosemorals.com", "www.example.com", "eve.example.com"}
+	if len(hosts) != len(expected) {
+		t.Fatalf("Expected hosts %v, got %v", expected, hosts)
+	}
+	for i := range expected {
+		if hosts[i] != expected[i] {
+			t.Errorf("Expected hosts %v, got %v", expected, hosts)
+		}
+	}
+}
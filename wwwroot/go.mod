@@ -0,0 +1 @@
+module github.com/moosemorals/mm/wwwroot
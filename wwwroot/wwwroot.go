@@ -0,0 +1,12 @@
+// Package wwwroot holds the site's static files, so they can be built
+// into the binary
+package wwwroot
+
+import "embed"
+
+// Files are the static files. The EVE static data export in eve/data
+// is only read by the eveapi package, so it's left out
+//
+//go:embed articles css images js tools favicon.ico index.html robots.txt
+//go:embed eve/*.html eve/*.css eve/*.js eve/*.png
+var Files embed.FS